@@ -21,20 +21,30 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/ini.v1"
 	"gorm.io/gorm"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 	"yggdrasil-go/model"
 	"yggdrasil-go/router"
+	"yggdrasil-go/service"
 	"yggdrasil-go/util"
 )
 
@@ -44,11 +54,35 @@ type MetaCfg struct {
 	ImplementationVersion string   `ini:"implementation_version"`
 	SkinDomains           []string `ini:"skin_domains"`
 	SkinRootUrl           string   `ini:"skin_root_url"`
+	SkinRootUrlHeader     string   `ini:"skin_root_url_header"`
+	SkinRootUrlMap        []string `ini:"skin_root_url_map"`
+	NoMojangNamespace     bool     `ini:"feature_no_mojang_namespace"`
+	MojangAntiFeatures    bool     `ini:"feature_enable_mojang_anti_features"`
+	ExtraRegistrationOpen bool     `ini:"extra_registration_open"`
 }
 
 type ServerCfg struct {
-	ServerAddress  string   `ini:"server_address"`
-	TrustedProxies []string `ini:"trusted_proxies"`
+	ServerAddress         string        `ini:"server_address"`
+	TrustedProxies        []string      `ini:"trusted_proxies"`
+	RemoteIPHeaders       []string      `ini:"remote_ip_headers"`
+	UnixSocketMode        string        `ini:"unix_socket_mode"`
+	TlsCertFile           string        `ini:"tls_cert_file"`
+	TlsKeyFile            string        `ini:"tls_key_file"`
+	AutocertDomains       []string      `ini:"autocert_domains"`
+	AutocertCacheDir      string        `ini:"autocert_cache_dir"`
+	DebugLogBodies        bool          `ini:"debug_log_bodies"`
+	PrettyJson            bool          `ini:"pretty_json"`
+	ReadHeaderTimeout     time.Duration `ini:"read_header_timeout"`
+	ReadTimeout           time.Duration `ini:"read_timeout"`
+	WriteTimeout          time.Duration `ini:"write_timeout"`
+	IdleTimeout           time.Duration `ini:"idle_timeout"`
+	SpaPathPrefix         string        `ini:"spa_path_prefix"`
+	Compression           bool          `ini:"compression"`
+	CompressionMinSize    int           `ini:"compression_min_size"`
+	MaxConcurrentRequests int           `ini:"max_concurrent_requests"`
+	ConcurrencyExempt     []string      `ini:"concurrency_exempt_paths"`
+	Maintenance           bool          `ini:"maintenance"`
+	ShutdownTimeout       time.Duration `ini:"shutdown_timeout"`
 }
 
 func main() {
@@ -63,6 +97,7 @@ func main() {
 		ImplementationVersion: "v0.0.1",
 		SkinDomains:           []string{".example.com", "localhost"},
 		SkinRootUrl:           "http://localhost:8080",
+		NoMojangNamespace:     true,
 	}
 	err = cfg.Section("meta").MapTo(&meta)
 	if err != nil {
@@ -71,6 +106,10 @@ func main() {
 	dbCfg := util.DbCfg{
 		DatabaseDriver: "sqlite",
 		DatabaseDsn:    "file:sqlite.db?cache=shared",
+		SlowThreshold:  200 * time.Millisecond,
+		LogLevel:       "warn",
+		ConnectTimeout: 30 * time.Second,
+		AutoMigrate:    true,
 	}
 	err = cfg.Section("database").MapTo(&dbCfg)
 	if err != nil {
@@ -87,76 +126,514 @@ func main() {
 			"192.168.0.0/16",
 			"172.16.0.0/12",
 		},
+		RemoteIPHeaders:    []string{"X-Forwarded-For", "X-Real-IP"},
+		UnixSocketMode:     "0660",
+		AutocertCacheDir:   "autocert",
+		ReadHeaderTimeout:  10 * time.Second,
+		ReadTimeout:        30 * time.Second,
+		WriteTimeout:       60 * time.Second,
+		IdleTimeout:        120 * time.Second,
+		SpaPathPrefix:      "/profile",
+		CompressionMinSize: 1024,
+		ConcurrencyExempt:  []string{"/metrics", "/status"},
+		ShutdownTimeout:    5 * time.Second,
 	}
 	err = cfg.Section("server").MapTo(&serverCfg)
 	if err != nil {
 		log.Fatal("无法读取配置文件", err)
 	}
+	if serverCfg.ShutdownTimeout <= 0 {
+		log.Fatal("shutdown_timeout 必须大于 0")
+	}
+	serviceCfg := router.ServiceCfg{
+		Token: service.TokenCfg{
+			RequireClientToken: false,
+			ValidDuration:      model.DefaultTokenValidDuration,
+			RefreshDuration:    model.DefaultTokenRefreshDuration,
+		},
+		User: service.UserCfg{
+			RegistrationOpen:     true,
+			RegisterLimitPerIp:   10,
+			BcryptCost:           bcrypt.DefaultCost,
+			UuidStrategy:         "random",
+			MojangNameCheck:      "allow",
+			ProfileKeyPoolSize:   100,
+			ProfileKeyGenerators: 1,
+			PasswordPolicy: service.PasswordPolicy{
+				MinLength: 6,
+			},
+			Privileges: service.PrivilegesCfg{
+				OnlineChat:        true,
+				MultiplayerServer: true,
+			},
+		},
+		Session: service.SessionCfg{
+			SignHasJoined: true,
+		},
+		RateLimit: service.RateLimitCfg{
+			Backend: "memory",
+		},
+		Texture: service.TextureCfg{
+			UploadableTextures: []string{"skin", "cape"},
+			Deduplicate:        true,
+			MaxSkinSize:        256,
+			MaxCapeSize:        512,
+			AllowedImageTypes:  []string{"png", "jpeg"},
+			MaxSkinBytes:       256 << 10,
+			MaxCapeBytes:       256 << 10,
+			MaxHdSkinSize:      512,
+			ScanTimeout:        5 * time.Second,
+		},
+		Cache: service.DefaultCacheCfg(),
+		Mojang: service.MojangCfg{
+			BulkSize:        service.MojangMaxBulkSize,
+			BulkConcurrency: 2,
+			BulkTimeout:     5 * time.Second,
+			LookupTimeout:   3 * time.Second,
+		},
+		Admin: service.AdminCfg{
+			DefaultPageSize: 20,
+			MaxPageSize:     100,
+		},
+	}
+	err = cfg.Section("token").MapTo(&serviceCfg.Token)
+	if err != nil {
+		log.Fatal("无法读取配置文件", err)
+	}
+	// MapTo 会忽略不大于 0 的时长并保留默认值, 因此直接检查配置项
+	for _, name := range []string{"valid_duration", "refresh_duration"} {
+		if key, err := cfg.Section("token").GetKey(name); err == nil {
+			if d, err := key.Duration(); err != nil || d <= 0 {
+				log.Fatalf("无效的令牌配置: %s 必须是大于 0 的时长\n", name)
+			}
+		}
+	}
+	if serviceCfg.Token.RefreshDuration < serviceCfg.Token.ValidDuration {
+		log.Fatal("无效的令牌配置: refresh_duration 不能小于 valid_duration")
+	}
+	err = cfg.Section("user").MapTo(&serviceCfg.User)
+	if err != nil {
+		log.Fatal("无法读取配置文件", err)
+	}
+	if serviceCfg.User.BcryptCost < bcrypt.MinCost || serviceCfg.User.BcryptCost > bcrypt.MaxCost {
+		log.Fatalf("无效的 bcrypt_cost: %d, 有效范围为 %d-%d\n", serviceCfg.User.BcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	switch serviceCfg.User.MojangNameCheck {
+	case "off", "allow", "deny":
+	default:
+		log.Fatalf("不支持的 mojang_name_check: %s, 可选 off, allow 或 deny\n", serviceCfg.User.MojangNameCheck)
+	}
+	if serviceCfg.User.UuidStrategy != "random" && serviceCfg.User.UuidStrategy != "offline" {
+		log.Fatalf("不支持的 uuid_strategy: %s, 可选 random 或 offline\n", serviceCfg.User.UuidStrategy)
+	}
+	if serviceCfg.User.ProfileKeyPoolSize < 0 || serviceCfg.User.ProfileKeyGenerators < 1 {
+		log.Fatal("无效的密钥对池配置: profile_key_pool_size 不能为负数, profile_key_generators 至少为 1")
+	}
+	if err := serviceCfg.User.ResolveKeyPoolWaterMarks(); err != nil {
+		log.Fatal("无效的密钥对池配置: ", err)
+	}
+	serviceCfg.User.ReservedNames, err = service.LoadReservedNames(serviceCfg.User.ReservedNamesList, serviceCfg.User.ReservedNamesFile)
+	if err != nil {
+		log.Fatal("无法读取保留角色名列表: ", err)
+	}
+	err = cfg.Section("password").MapTo(&serviceCfg.User.PasswordPolicy)
+	if err != nil {
+		log.Fatal("无法读取配置文件", err)
+	}
+	err = cfg.Section("privileges").MapTo(&serviceCfg.User.Privileges)
+	if err != nil {
+		log.Fatal("无法读取配置文件", err)
+	}
+	err = cfg.Section("session").MapTo(&serviceCfg.Session)
+	if err != nil {
+		log.Fatal("无法读取配置文件", err)
+	}
+	err = cfg.Section("rate_limit").MapTo(&serviceCfg.RateLimit)
+	if err != nil {
+		log.Fatal("无法读取配置文件", err)
+	}
+	err = cfg.Section("texture").MapTo(&serviceCfg.Texture)
+	if err != nil {
+		log.Fatal("无法读取配置文件", err)
+	}
+	for i, textureType := range serviceCfg.Texture.UploadableTextures {
+		textureType = strings.ToLower(strings.TrimSpace(textureType))
+		if textureType != "skin" && textureType != "cape" && textureType != "elytra" {
+			log.Fatalf("不支持的材质类型: %s\n", textureType)
+		}
+		serviceCfg.Texture.UploadableTextures[i] = textureType
+	}
+	for i, imageType := range serviceCfg.Texture.AllowedImageTypes {
+		imageType = strings.ToLower(strings.TrimSpace(imageType))
+		if !service.IsSupportedImageType(imageType) {
+			log.Fatalf("不支持的图像格式: %s\n", imageType)
+		}
+		serviceCfg.Texture.AllowedImageTypes[i] = imageType
+	}
+	if serviceCfg.Texture.MaxSkinBytes < 1 || serviceCfg.Texture.MaxSkinBytes > service.MaxTextureBytes ||
+		serviceCfg.Texture.MaxCapeBytes < 1 || serviceCfg.Texture.MaxCapeBytes > service.MaxTextureBytes {
+		log.Fatalf("材质文件大小上限必须在 1 到 %d 字节之间\n", service.MaxTextureBytes)
+	}
+	if len(serviceCfg.Texture.ScanUrl) > 0 {
+		if scanUrl, err := url.Parse(serviceCfg.Texture.ScanUrl); err != nil || (scanUrl.Scheme != "http" && scanUrl.Scheme != "https") {
+			log.Fatalf("无效的 scan_url: %s\n", serviceCfg.Texture.ScanUrl)
+		}
+		if serviceCfg.Texture.ScanTimeout <= 0 {
+			log.Fatal("scan_timeout 必须大于 0")
+		}
+	}
+	if serviceCfg.Texture.MaxHdSkinSize < 128 || serviceCfg.Texture.MaxHdSkinSize > service.MaxTextureDimension {
+		log.Fatalf("max_hd_skin_size 必须在 128 到 %d 之间\n", service.MaxTextureDimension)
+	}
+	if serviceCfg.Texture.MaxSkinSize < 1 || serviceCfg.Texture.MaxSkinSize > service.MaxTextureDimension ||
+		serviceCfg.Texture.MaxCapeSize < 1 || serviceCfg.Texture.MaxCapeSize > service.MaxTextureDimension {
+		log.Fatalf("材质尺寸上限必须在 1 到 %d 之间\n", service.MaxTextureDimension)
+	}
+	httpCfg := util.HttpCfg{
+		RetryCount: 2,
+	}
+	err = cfg.Section("cache").MapTo(&serviceCfg.Cache)
+	if err != nil {
+		log.Fatal("无法读取配置文件", err)
+	}
+	if err := serviceCfg.Cache.Validate(); err != nil {
+		log.Fatal("无效的缓存配置: ", err)
+	}
+	err = cfg.Section("admin").MapTo(&serviceCfg.Admin)
+	if err != nil {
+		log.Fatal("无法读取配置文件", err)
+	}
+	if serviceCfg.Admin.DefaultPageSize < 1 || serviceCfg.Admin.MaxPageSize < serviceCfg.Admin.DefaultPageSize {
+		log.Fatal("无效的管理接口配置: default_page_size 至少为 1, 且不能大于 max_page_size")
+	}
+	if serviceCfg.User.RegisterApproval && len(serviceCfg.Admin.Token) == 0 {
+		log.Println("警告: 已开启注册审核但未配置管理令牌, 新注册的账号将无法被审核")
+	}
+	if serviceCfg.User.RequireInviteCode && len(serviceCfg.Admin.Token) == 0 {
+		log.Println("警告: 已开启邀请注册但未配置管理令牌, 将无法创建邀请码")
+	}
+	err = cfg.Section("mojang").MapTo(&serviceCfg.Mojang)
+	if err != nil {
+		log.Fatal("无法读取配置文件", err)
+	}
+	if serviceCfg.Mojang.BulkSize < 1 || serviceCfg.Mojang.BulkSize > service.MojangMaxBulkSize {
+		log.Fatalf("bulk_size 必须在 1 到 %d 之间\n", service.MojangMaxBulkSize)
+	}
+	if serviceCfg.Mojang.BulkConcurrency < 1 || serviceCfg.Mojang.BulkTimeout <= 0 || serviceCfg.Mojang.LookupTimeout <= 0 {
+		log.Fatal("bulk_concurrency 必须大于 0, bulk_timeout 和 lookup_timeout 必须为正数")
+	}
+	err = cfg.Section("http").MapTo(&httpCfg)
+	if err != nil {
+		log.Fatal("无法读取配置文件", err)
+	}
+	if err := util.SetHttpCfg(httpCfg); err != nil {
+		log.Fatal(err)
+	}
 	_, err = os.Stat(configFilePath)
 	if err != nil && os.IsNotExist(err) {
 		log.Println("配置文件不存在，已使用默认配置")
 		_ = cfg.Section("meta").ReflectFrom(&meta)
 		_ = cfg.Section("database").ReflectFrom(&dbCfg)
 		_ = cfg.Section("server").ReflectFrom(&serverCfg)
+		_ = cfg.Section("token").ReflectFrom(&serviceCfg.Token)
+		_ = cfg.Section("user").ReflectFrom(&serviceCfg.User)
+		_ = cfg.Section("password").ReflectFrom(&serviceCfg.User.PasswordPolicy)
+		_ = cfg.Section("privileges").ReflectFrom(&serviceCfg.User.Privileges)
+		_ = cfg.Section("session").ReflectFrom(&serviceCfg.Session)
+		_ = cfg.Section("rate_limit").ReflectFrom(&serviceCfg.RateLimit)
+		_ = cfg.Section("texture").ReflectFrom(&serviceCfg.Texture)
+		_ = cfg.Section("cache").ReflectFrom(&serviceCfg.Cache)
+		_ = cfg.Section("admin").ReflectFrom(&serviceCfg.Admin)
+		_ = cfg.Section("mojang").ReflectFrom(&serviceCfg.Mojang)
+		_ = cfg.Section("http").ReflectFrom(&httpCfg)
 		err = cfg.SaveToIndent(configFilePath, " ")
 		if err != nil {
 			log.Println("警告: 无法保存配置文件", err)
 		}
 	}
-	checkRsaKeyFile(privateKeyPath, publicKeyPath)
-	publicKeyContent, err := os.ReadFile(publicKeyPath)
-	if err != nil {
-		log.Fatal("无法读取公钥内容", err)
+	var publicKeyContent []byte
+	if privateKeyContent, ok := loadRsaKeyFromEnv(); ok {
+		privateKey, err := parseRsaPrivateKey(privateKeyContent)
+		if err != nil {
+			log.Fatal("无法解析环境变量中的私钥", err)
+		}
+		util.PrivateKey = privateKey
+		publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+		if err != nil {
+			log.Fatal("无法序列化 RSA 公钥", err)
+		}
+		publicKeyContent = pem.EncodeToMemory(&pem.Block{
+			Type:  "PUBLIC KEY",
+			Bytes: publicKeyBytes,
+		})
+	} else {
+		checkRsaKeyFile(privateKeyPath, publicKeyPath)
+		publicKeyContent, err = os.ReadFile(publicKeyPath)
+		if err != nil {
+			log.Fatal("无法读取公钥内容", err)
+		}
 	}
-	db, err := gorm.Open(util.GetDialector(dbCfg), &gorm.Config{
-		SkipDefaultTransaction: true,
-	})
-	if err != nil {
-		log.Fatal("无法连接数据库", err)
+	models := []interface{}{&model.User{}, &model.Texture{}, &model.UserTexture{}, &model.Block{}, &model.InviteCode{}, &model.TextureHistory{}}
+	if serviceCfg.RateLimit.Backend == "database" {
+		models = append(models, &model.RateLimit{})
 	}
-	err = db.AutoMigrate(&model.User{}, &model.Texture{})
+	db := connectDatabase(dbCfg, models)
+	err = service.MigrateUserTextures(db)
 	if err != nil {
-		log.Fatal("无法导入数据库", err)
+		log.Fatal("无法迁移用户材质数据", err)
 	}
 	serverMeta := router.ServerMeta{}
 	serverMeta.Meta.ServerName = meta.ServerName
 	serverMeta.Meta.ImplementationName = meta.ImplementationName
 	serverMeta.Meta.ImplementationVersion = meta.ImplementationVersion
-	serverMeta.Meta.FeatureNoMojangNamespace = true
+	serverMeta.Meta.FeatureNoMojangNamespace = meta.NoMojangNamespace
 	serverMeta.Meta.FeatureEnableProfileKey = true
-	serverMeta.Meta.Links.Homepage = meta.SkinRootUrl + "/profile/"
-	serverMeta.Meta.Links.Register = meta.SkinRootUrl + "/profile/"
+	serverMeta.Meta.FeatureEnableMojangAntiFeatures = meta.MojangAntiFeatures
+	spaPathPrefix := "/" + strings.Trim(serverCfg.SpaPathPrefix, "/")
+	if spaPathPrefix == "/" {
+		log.Fatal("spa_path_prefix 不能为根路径")
+	}
+	serverMeta.Meta.Links.Homepage = meta.SkinRootUrl + spaPathPrefix + "/"
+	serverMeta.Meta.Links.Register = meta.SkinRootUrl + spaPathPrefix + "/"
 	serverMeta.SkinDomains = meta.SkinDomains
 	serverMeta.SignaturePublickey = string(publicKeyContent)
-	r := gin.Default()
+	serverMeta.ExtraRegistrationOpen = meta.ExtraRegistrationOpen
+	if extraKeys := cfg.Section("meta_extra").Keys(); len(extraKeys) > 0 {
+		serverMeta.Extra = make(map[string]interface{}, len(extraKeys))
+		for _, key := range extraKeys {
+			serverMeta.Extra[key.Name()] = key.String()
+		}
+	}
+	r := gin.New()
+	// 请求 ID 与跨域头最先设置, 使被限流或恢复的响应也带有它们
+	r.Use(router.RequestId(), router.Cors())
+	r.Use(gin.LoggerWithFormatter(router.LogFormatter), gin.Recovery(), router.TrackInFlight)
+	if serverCfg.MaxConcurrentRequests > 0 {
+		r.Use(router.ConcurrencyLimit(serverCfg.MaxConcurrentRequests, serverCfg.ConcurrencyExempt))
+	}
+	if serverCfg.Compression {
+		r.Use(router.Compress(serverCfg.CompressionMinSize))
+	}
+	r.Use(router.PrettyJSON(serverCfg.PrettyJson))
+	if serverCfg.DebugLogBodies {
+		r.Use(router.DebugBodyLogger(4096))
+	}
+	r.RemoteIPHeaders = serverCfg.RemoteIPHeaders
 	err = r.SetTrustedProxies(serverCfg.TrustedProxies)
 	if err != nil {
 		log.Fatal(err)
 	}
-	router.InitRouters(r, db, &serverMeta, meta.SkinRootUrl)
-	r.Static("/profile", "assets")
+	router.SetMaintenance(serverCfg.Maintenance)
+	service.SetRegistrationOpen(serviceCfg.User.RegistrationOpen)
+	skinRootUrls := router.SkinRootUrls{
+		Default:  meta.SkinRootUrl,
+		Header:   meta.SkinRootUrlHeader,
+		ByHeader: make(map[string]string),
+	}
+	for _, entry := range meta.SkinRootUrlMap {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 || len(strings.TrimSpace(kv[1])) == 0 {
+			log.Fatalf("无效的 skin_root_url_map 配置: %s\n", entry)
+		}
+		skinRootUrls.ByHeader[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	for _, skinRootUrl := range skinRootUrls.Uncovered(meta.SkinDomains) {
+		log.Printf("警告: 材质地址 %s 的域名不在 skin_domains 中, 客户端将拒绝加载该地址上的材质, 请检查配置\n", skinRootUrl)
+	}
+	router.InitRouters(r, db, &serverMeta, skinRootUrls, serviceCfg)
+	r.Static(spaPathPrefix, "assets")
+	r.NoRoute(router.NoRoute(spaPathPrefix, "assets/index.html"))
 	srv := &http.Server{
-		Addr:    serverCfg.ServerAddress,
-		Handler: r,
+		Addr:              serverCfg.ServerAddress,
+		Handler:           r,
+		ReadHeaderTimeout: serverCfg.ReadHeaderTimeout,
+		ReadTimeout:       serverCfg.ReadTimeout,
+		WriteTimeout:      serverCfg.WriteTimeout,
+		IdleTimeout:       serverCfg.IdleTimeout,
 	}
+	listener, socketPath, err := listen(serverCfg.ServerAddress, serverCfg.UnixSocketMode)
+	if err != nil {
+		log.Fatal("无法监听地址: ", err)
+	}
+	useTls := configureTls(srv, serverCfg)
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && errors.Is(err, http.ErrServerClosed) {
+		if useTls {
+			err = srv.ServeTLS(listener, serverCfg.TlsCertFile, serverCfg.TlsKeyFile)
+		} else {
+			err = srv.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Printf("listen: %s\n", err)
 		}
 	}()
 	log.Printf("已启动, 地址: %s\n", srv.Addr)
-	quit := make(chan os.Signal)
+	go reloadOnHangup(configFilePath)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
-	log.Println("关闭...")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	log.Printf("关闭..., 正在处理的请求: %d, 最长等待: %s\n", router.InFlightRequests(), serverCfg.ShutdownTimeout)
+	shutdownStart := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), serverCfg.ShutdownTimeout)
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("强制关闭:", err)
+		log.Fatalf("强制关闭: %s, 耗时: %s, 未完成的请求: %d\n", err, time.Since(shutdownStart).Round(time.Millisecond), router.InFlightRequests())
+	}
+	log.Printf("所有请求已处理完毕, 耗时: %s\n", time.Since(shutdownStart).Round(time.Millisecond))
+	if len(socketPath) > 0 {
+		_ = os.Remove(socketPath)
 	}
 	log.Println("退出")
 }
 
+// connectDatabase 连接数据库并导入表结构, 失败时按指数退避重试, 总等待时间不超过 ConnectTimeout
+func connectDatabase(dbCfg util.DbCfg, models []interface{}) *gorm.DB {
+	deadline := time.Now().Add(dbCfg.ConnectTimeout)
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		db, err := gorm.Open(util.GetDialector(dbCfg), &gorm.Config{
+			SkipDefaultTransaction: true,
+			Logger:                 util.GetLogger(dbCfg),
+		})
+		if err == nil {
+			if dbCfg.AutoMigrate {
+				err = db.AutoMigrate(models...)
+			} else {
+				err = checkTables(db, models)
+			}
+			if err == nil {
+				return db
+			}
+			if sqlDB, e := db.DB(); e == nil {
+				_ = sqlDB.Close()
+			}
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			log.Fatal("无法连接数据库", err)
+		}
+		if backoff < wait {
+			wait = backoff
+		}
+		log.Printf("第 %d 次连接数据库失败, %s 后重试: %v\n", attempt, wait, err)
+		time.Sleep(wait)
+		if backoff < 16*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// checkTables 关闭自动迁移时检查所需的表是否都已存在
+func checkTables(db *gorm.DB, models []interface{}) error {
+	if err := db.Exec("SELECT 1").Error; err != nil {
+		return err
+	}
+	var missing []string
+	for _, m := range models {
+		if !db.Migrator().HasTable(m) {
+			stmt := &gorm.Statement{DB: db}
+			if err := stmt.Parse(m); err != nil {
+				return err
+			}
+			missing = append(missing, stmt.Schema.Table)
+		}
+	}
+	if len(missing) > 0 {
+		log.Fatalf("已关闭自动迁移, 但数据库中缺少以下表: %s\n", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// configureTls 配置了证书或自动证书域名时为服务器启用 HTTPS, 仅允许 TLS 1.2 及以上版本
+func configureTls(srv *http.Server, serverCfg ServerCfg) bool {
+	useAutocert := len(serverCfg.AutocertDomains) > 0
+	if !useAutocert && (len(serverCfg.TlsCertFile) == 0 || len(serverCfg.TlsKeyFile) == 0) {
+		return false
+	}
+	srv.TLSConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+	}
+	if useAutocert {
+		// 通过 TLS-ALPN-01 质询自动申请 Let's Encrypt 证书, 需要监听 443 端口
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(serverCfg.AutocertDomains...),
+			Cache:      autocert.DirCache(serverCfg.AutocertCacheDir),
+		}
+		srv.TLSConfig.GetCertificate = manager.GetCertificate
+		srv.TLSConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		log.Printf("已启用自动证书, 域名: %s\n", strings.Join(serverCfg.AutocertDomains, ", "))
+	}
+	return true
+}
+
+// listen 监听 TCP 地址, 地址为 unix:/path/to/socket 形式时监听 Unix 套接字并返回套接字路径
+func listen(address string, socketMode string) (net.Listener, string, error) {
+	if !strings.HasPrefix(address, "unix:") {
+		listener, err := net.Listen("tcp", address)
+		return listener, "", err
+	}
+	socketPath := strings.TrimPrefix(address, "unix:")
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil {
+		return nil, "", fmt.Errorf("无效的 unix_socket_mode: %s", socketMode)
+	}
+	// 清理上次异常退出残留的套接字文件
+	if info, err := os.Stat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(socketPath)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := os.Chmod(socketPath, os.FileMode(mode)); err != nil {
+		_ = listener.Close()
+		return nil, "", err
+	}
+	return listener, socketPath, nil
+}
+
+// reloadOnHangup 收到 SIGHUP 时重新读取配置文件中可在运行时修改的配置
+func reloadOnHangup(configFilePath string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		cfg, err := ini.LooseLoad(configFilePath)
+		if err != nil {
+			log.Println("无法重新读取配置文件", err)
+			continue
+		}
+		maintenance := cfg.Section("server").Key("maintenance").MustBool(false)
+		router.SetMaintenance(maintenance)
+		registrationOpen := cfg.Section("user").Key("registration_open").MustBool(true)
+		service.SetRegistrationOpen(registrationOpen)
+		log.Printf("已重新读取配置文件, 维护模式: %t, 开放注册: %t\n", maintenance, registrationOpen)
+	}
+}
+
+// loadRsaKeyFromEnv 从环境变量 YGG_PRIVATE_KEY (PEM 内容) 或 YGG_PRIVATE_KEY_FILE (如挂载的 secret 路径) 读取私钥,
+// 提供时不会生成或写入任何密钥文件
+func loadRsaKeyFromEnv() ([]byte, bool) {
+	if content, ok := os.LookupEnv("YGG_PRIVATE_KEY"); ok && len(content) > 0 {
+		return []byte(content), true
+	}
+	if path, ok := os.LookupEnv("YGG_PRIVATE_KEY_FILE"); ok && len(path) > 0 {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalln("无法读取私钥文件", err)
+		}
+		return content, true
+	}
+	return nil, false
+}
+
 func checkRsaKeyFile(privateKeyPath string, publicKeyPath string) {
 	_, err := os.Stat(privateKeyPath)
 	if err != nil && os.IsNotExist(err) {
@@ -204,11 +681,26 @@ func checkRsaKeyFile(privateKeyPath string, publicKeyPath string) {
 		if err != nil {
 			log.Fatalln("无法打开私钥文件", err)
 		}
-		pemBlock, _ := pem.Decode(pemContent)
-		privateKeyI, err := x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
+		privateKey, err := parseRsaPrivateKey(pemContent)
 		if err != nil {
 			log.Fatalln("无法解析私钥文件", err)
 		}
-		util.PrivateKey = privateKeyI.(*rsa.PrivateKey)
+		util.PrivateKey = privateKey
+	}
+}
+
+func parseRsaPrivateKey(pemContent []byte) (*rsa.PrivateKey, error) {
+	pemBlock, _ := pem.Decode(pemContent)
+	if pemBlock == nil {
+		return nil, errors.New("不是有效的 PEM 格式")
+	}
+	privateKeyI, err := x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := privateKeyI.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("需要 PKCS8 格式的 RSA 私钥, 实际类型为 %T", privateKeyI)
 	}
+	return privateKey, nil
 }
@@ -0,0 +1,29 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package model
+
+import "time"
+
+// InviteCode 注册邀请码, 开启邀请注册后注册时必须提供
+type InviteCode struct {
+	Code      string `gorm:"size:32;primaryKey"`
+	MaxUses   int    `gorm:"not null"`
+	Used      int    `gorm:"not null;default:0"`
+	ExpiresAt *time.Time
+	CreatedAt time.Time
+}
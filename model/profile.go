@@ -19,7 +19,9 @@ package model
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/google/uuid"
+	"strings"
 	"time"
 	"yggdrasil-go/util"
 )
@@ -29,6 +31,8 @@ type Profile struct {
 	Name      string
 	ModelType ModelType
 	Textures  map[string]string
+	// HdSkinSize 高清皮肤 (Textures["SKIN_HD"]) 的边长
+	HdSkinSize int
 }
 
 type ModelType string
@@ -50,22 +54,26 @@ type CapeTexture struct {
 }
 
 type TexturesType struct {
-	SKIN *SkinTexture `json:"SKIN,omitempty"`
-	CAPE *CapeTexture `json:"CAPE,omitempty"`
+	SKIN   *SkinTexture `json:"SKIN,omitempty"`
+	CAPE   *CapeTexture `json:"CAPE,omitempty"`
+	ELYTRA *CapeTexture `json:"ELYTRA,omitempty"`
 }
 
-func NewProfile(id uuid.UUID, name string, modelType ModelType, serializedTextures string) (this Profile) {
+func NewProfile(id uuid.UUID, name string, modelType ModelType, serializedTextures string) (this Profile, err error) {
 	this.Id = id
 	this.Name = name
 	this.ModelType = modelType
 	if len(serializedTextures) < 2 {
 		serializedTextures = "{}"
 	}
-	err := json.Unmarshal([]byte(serializedTextures), &this.Textures)
+	err = json.Unmarshal([]byte(serializedTextures), &this.Textures)
 	if err != nil {
-		panic(err)
+		return this, fmt.Errorf("invalid serialized textures of profile %s: %w", util.UnsignedString(id), err)
 	}
-	return this
+	if this.Textures == nil {
+		this.Textures = map[string]string{}
+	}
+	return this, nil
 }
 
 type ProfileResponse struct {
@@ -80,16 +88,23 @@ func (p *Profile) ToSimpleResponse() ProfileResponse {
 	}
 }
 
-func (p *Profile) ToCompleteResponse(signed bool, textureBaseUrl string) (map[string]interface{}, error) {
+// ToCompleteResponse hdSkins 为 true 时在皮肤的 metadata 中附带高清皮肤的地址和分辨率
+func (p *Profile) ToCompleteResponse(signed bool, textureBaseUrl string, uploadableTextures []string, hdSkins bool) (map[string]interface{}, error) {
 	textures := TexturesType{}
 	if hash, ok := p.Textures["SKIN"]; ok {
 		skin := SkinTexture{
 			Url: textureBaseUrl + "/" + hash,
 		}
+		m := MetadataType{}
 		if p.ModelType == ALEX {
-			m := MetadataType{
-				"model": ALEX,
-			}
+			m["model"] = ALEX
+		}
+		// authlib 将 metadata 解析为 Map<String, String>, 值只能是字符串
+		if hdHash, ok := p.Textures["SKIN_HD"]; ok && hdSkins && p.HdSkinSize > 0 {
+			m["hdUrl"] = textureBaseUrl + "/" + hdHash
+			m["hdResolution"] = fmt.Sprintf("%dx%d", p.HdSkinSize, p.HdSkinSize)
+		}
+		if len(m) > 0 {
 			skin.Metadata = &m
 		}
 		textures.SKIN = &skin
@@ -100,6 +115,12 @@ func (p *Profile) ToCompleteResponse(signed bool, textureBaseUrl string) (map[st
 		}
 		textures.CAPE = &cape
 	}
+	if hash, ok := p.Textures["ELYTRA"]; ok {
+		elytra := CapeTexture{
+			Url: textureBaseUrl + "/" + hash,
+		}
+		textures.ELYTRA = &elytra
+	}
 	texturesStr, err := util.EncodeBase64(util.Property{
 		Name: "timestamp", Value: time.Now().UnixMilli(),
 	}, util.Property{
@@ -116,7 +137,7 @@ func (p *Profile) ToCompleteResponse(signed bool, textureBaseUrl string) (map[st
 	}
 	properties := util.Properties(signed,
 		util.StringProperty{Name: "textures", Value: texturesStr},
-		util.StringProperty{Name: "uploadableTextures", Value: "skin,cape"},
+		util.StringProperty{Name: "uploadableTextures", Value: strings.Join(uploadableTextures, ",")},
 	)
 	return map[string]interface{}{
 		"id":         util.UnsignedString(p.Id),
@@ -125,6 +146,36 @@ func (p *Profile) ToCompleteResponse(signed bool, textureBaseUrl string) (map[st
 	}, nil
 }
 
+// SanitizeProfileResponse 只保留上游 (Mojang) 角色响应中已知的字段, 丢弃其他任何字段
+func SanitizeProfileResponse(raw map[string]interface{}) map[string]interface{} {
+	sanitized := make(map[string]interface{})
+	for _, key := range []string{"id", "name"} {
+		if value, ok := raw[key].(string); ok {
+			sanitized[key] = value
+		}
+	}
+	properties := make([]map[string]string, 0)
+	if rawProperties, ok := raw["properties"].([]interface{}); ok {
+		for _, rawProperty := range rawProperties {
+			propertyMap, ok := rawProperty.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			property := make(map[string]string)
+			for _, key := range []string{"name", "value", "signature"} {
+				if value, ok := propertyMap[key].(string); ok {
+					property[key] = value
+				}
+			}
+			if len(property["name"]) > 0 {
+				properties = append(properties, property)
+			}
+		}
+	}
+	sanitized["properties"] = properties
+	return sanitized
+}
+
 func (p *Profile) Equals(another *Profile) bool {
 	return p == another || p.Id == another.Id
 }
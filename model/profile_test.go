@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package model
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSanitizeProfileResponse(t *testing.T) {
+	raw := map[string]interface{}{}
+	// 按上游 JSON 解码, 与实际收到的响应类型一致
+	err := json.Unmarshal([]byte(`{
+		"id": "069a79f444e94726a5befca90e38aaf5",
+		"name": "Notch",
+		"legacy": true,
+		"profileActions": ["FORCED_NAME_CHANGE"],
+		"extra": {"nested": "value"},
+		"properties": [
+			{"name": "textures", "value": "e30=", "signature": "c2ln", "tracking": "drop me"},
+			{"name": "unsigned", "value": "e30="},
+			{"name": 42, "value": "numeric name"},
+			{"value": "missing name"},
+			{"name": "numericValue", "value": 1, "signature": null},
+			"not an object"
+		]
+	}`), &raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"id":   "069a79f444e94726a5befca90e38aaf5",
+		"name": "Notch",
+		"properties": []map[string]string{
+			{"name": "textures", "value": "e30=", "signature": "c2ln"},
+			{"name": "unsigned", "value": "e30="},
+			{"name": "numericValue"},
+		},
+	}
+	if got := SanitizeProfileResponse(raw); !reflect.DeepEqual(got, want) {
+		t.Errorf("SanitizeProfileResponse() = %#v, want %#v", got, want)
+	}
+}
+
+func TestSanitizeProfileResponseNonStringFields(t *testing.T) {
+	raw := map[string]interface{}{
+		"id":         123,
+		"name":       map[string]interface{}{"first": "Notch"},
+		"properties": "not a list",
+	}
+	want := map[string]interface{}{"properties": []map[string]string{}}
+	if got := SanitizeProfileResponse(raw); !reflect.DeepEqual(got, want) {
+		t.Errorf("SanitizeProfileResponse() = %#v, want %#v", got, want)
+	}
+}
@@ -0,0 +1,27 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package model
+
+import "time"
+
+// RateLimit 共享限流器的令牌桶状态
+type RateLimit struct {
+	ID        string  `gorm:"size:255;primaryKey"`
+	Tokens    float64 `gorm:"not null"`
+	UpdatedAt time.Time
+}
@@ -20,6 +20,7 @@ package model
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"github.com/google/uuid"
 	"image"
 	"image/color"
 	"time"
@@ -64,6 +65,15 @@ func ComputeTextureId(img image.Image) string {
 	return hex.EncodeToString(digest.Sum(nil))
 }
 
+// ScopedTextureId 不去重时使用的材质 ID, 按用户和材质类型区分相同的图像
+func ScopedTextureId(textureId string, userId uuid.UUID, textureType string) string {
+	digest := sha256.New()
+	digest.Write([]byte(textureId))
+	digest.Write(userId[:])
+	digest.Write([]byte(textureType))
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
 func putInt(buf []byte, n int32) {
 	buf[0] = byte(n >> 24 & 0xff)
 	buf[1] = byte(n >> 16 & 0xff)
@@ -0,0 +1,34 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package model
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// TextureHistory 材质变更记录, 只保存材质 hash, 不计入材质的引用计数, 对应的材质可能已被删除
+type TextureHistory struct {
+	ID          uint      `gorm:"primaryKey"`
+	UserID      uuid.UUID `gorm:"type:string;size:36;not null;index:texture_history_user_idx"`
+	TextureType string    `gorm:"size:8;not null"`
+	// OldHash 为空表示新增材质, NewHash 为空表示删除材质
+	OldHash   string `gorm:"size:64"`
+	NewHash   string `gorm:"size:64"`
+	CreatedAt time.Time
+}
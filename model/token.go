@@ -27,6 +27,11 @@ type Token struct {
 	ClientToken     string
 	AccessToken     string
 	SelectedProfile Profile
+	// Family 令牌族, 同一次登录经刷新产生的令牌属于同一族
+	Family string
+	// validFor 签发后保持 Valid 的时长, 之后需要刷新; refreshableFor 签发后可以刷新的时长, 之后失效
+	validFor       time.Duration
+	refreshableFor time.Duration
 }
 
 type AvailableLevel uint
@@ -37,8 +42,16 @@ const (
 	Invalid
 )
 
-func NewToken(accessToken string, clientToken *string, selectedProfile *Profile) (this Token) {
+// DefaultTokenValidDuration 令牌签发后无需刷新即可使用的默认时长
+const DefaultTokenValidDuration = time.Hour * 24 * 15
+
+// DefaultTokenRefreshDuration 令牌签发后仍可刷新的默认时长
+const DefaultTokenRefreshDuration = time.Hour * 24 * 30
+
+func NewToken(accessToken string, clientToken *string, selectedProfile *Profile, validFor time.Duration, refreshableFor time.Duration) (this Token) {
 	this.createAt = time.Now().UnixMilli()
+	this.validFor = validFor
+	this.refreshableFor = refreshableFor
 
 	if clientToken == nil || (len(*clientToken) == 0) {
 		this.ClientToken = util.RandomUUID()
@@ -47,16 +60,38 @@ func NewToken(accessToken string, clientToken *string, selectedProfile *Profile)
 	}
 	this.AccessToken = accessToken
 	this.SelectedProfile = *selectedProfile
+	this.Family = util.RandomUUID()
 	return this
 }
 
+func (l AvailableLevel) String() string {
+	switch l {
+	case Valid:
+		return "Valid"
+	case NeedRefresh:
+		return "NeedRefresh"
+	default:
+		return "Invalid"
+	}
+}
+
 func (t *Token) GetAvailableLevel() AvailableLevel {
 	d := time.Now().Sub(time.UnixMilli(t.createAt))
-	if d > time.Hour*24*30 {
+	if d > t.refreshableFor {
 		return Invalid
-	} else if d > time.Hour*24*15 {
+	} else if d > t.validFor {
 		return NeedRefresh
 	} else {
 		return Valid
 	}
 }
+
+// RefreshAt 令牌需要刷新的时间
+func (t *Token) RefreshAt() time.Time {
+	return time.UnixMilli(t.createAt).Add(t.validFor)
+}
+
+// ExpiresAt 令牌失效的时间
+func (t *Token) ExpiresAt() time.Time {
+	return time.UnixMilli(t.createAt).Add(t.refreshableFor)
+}
@@ -18,7 +18,9 @@
 package model
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"github.com/google/uuid"
 	"time"
 	"yggdrasil-go/util"
@@ -28,12 +30,19 @@ type User struct {
 	ID                 uuid.UUID `gorm:"column:id;type:string;size:36;primaryKey"`
 	CreatedAt          time.Time
 	UpdatedAt          time.Time
-	Email              string   `gorm:"size:64;uniqueIndex:email_idx"`
-	Password           string   `gorm:"size:255"`
-	ProfileName        string   `gorm:"size:64;uniqueIndex:profile_name_idx"`
-	ProfileModelType   string   `gorm:"size:8;default:STEVE"`
-	SerializedTextures string   `gorm:"type:TEXT NULL"`
-	profile            *Profile `gorm:"-"`
+	Email              string `gorm:"size:64;uniqueIndex:email_idx"`
+	Password           string `gorm:"size:255"`
+	ProfileName        string `gorm:"size:64;uniqueIndex:profile_name_idx"`
+	ProfileModelType   string `gorm:"size:8;default:STEVE"`
+	SerializedTextures string `gorm:"type:TEXT NULL"`
+	Pending            bool   `gorm:"not null;default:false"`
+	// 单独限制某个玩家的权限, 为 false 时使用 [privileges] 中的全局配置
+	ChatDisabled        bool `gorm:"not null;default:false"`
+	MultiplayerDisabled bool `gorm:"not null;default:false"`
+	RealmsDisabled      bool `gorm:"not null;default:false"`
+	// 高清皮肤 (SKIN_HD) 的边长, 没有高清皮肤时为 0
+	HdSkinSize int      `gorm:"not null;default:0"`
+	profile    *Profile `gorm:"-"`
 }
 
 func (u *User) Profile() (*Profile, error) {
@@ -49,12 +58,23 @@ func (u *User) Profile() (*Profile, error) {
 		} else {
 			modelType = STEVE
 		}
-		profile := NewProfile(u.ID, u.ProfileName, modelType, u.SerializedTextures)
+		profile, err := NewProfile(u.ID, u.ProfileName, modelType, u.SerializedTextures)
+		if err != nil {
+			return nil, err
+		}
+		profile.HdSkinSize = u.HdSkinSize
 		return &profile, nil
 	}
 }
 
-func (u *User) SetProfile(p *Profile) {
+func (u *User) SetProfile(p *Profile) error {
+	if err := validateTextures(p.Textures); err != nil {
+		return err
+	}
+	serialized, err := json.Marshal(p.Textures)
+	if err != nil {
+		return err
+	}
 	u.profile = p
 	u.ProfileName = p.Name
 	switch p.ModelType {
@@ -65,11 +85,25 @@ func (u *User) SetProfile(p *Profile) {
 		u.ProfileModelType = "STEVE"
 		break
 	}
-	serialized, err := json.Marshal(p.Textures)
-	if err != nil {
-		panic("Can not serialize texture")
-	}
 	u.SerializedTextures = string(serialized)
+	u.HdSkinSize = p.HdSkinSize
+	return nil
+}
+
+// validateTextures 材质表只允许已知的材质类型, 值为材质 hash
+func validateTextures(textures map[string]string) error {
+	for textureType, hash := range textures {
+		if textureType != "SKIN" && textureType != "SKIN_HD" && textureType != "CAPE" && textureType != "ELYTRA" {
+			return fmt.Errorf("invalid texture type: %.16q", textureType)
+		}
+		if len(hash) == 0 || len(hash) > 64 {
+			return fmt.Errorf("invalid texture hash for %s", textureType)
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return fmt.Errorf("invalid texture hash for %s", textureType)
+		}
+	}
+	return nil
 }
 
 type UserResponse struct {
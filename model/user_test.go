@@ -0,0 +1,100 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package model
+
+import (
+	"github.com/google/uuid"
+	"strings"
+	"testing"
+)
+
+func TestUserProfileSerializedTextures(t *testing.T) {
+	tests := []struct {
+		name       string
+		serialized string
+		wantErr    bool
+		wantSkin   string
+	}{
+		{name: "empty", serialized: ""},
+		{name: "null", serialized: "null"},
+		{name: "empty object", serialized: "{}"},
+		{name: "skin", serialized: `{"SKIN":"abcdef"}`, wantSkin: "abcdef"},
+		{name: "malformed", serialized: "{bad", wantErr: true},
+		{name: "array", serialized: "[]", wantErr: true},
+		{name: "non-string hash", serialized: `{"SKIN":1}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := User{ID: uuid.New(), ProfileName: "Tester", SerializedTextures: tt.serialized}
+			profile, err := user.Profile()
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "invalid serialized textures") {
+					t.Fatalf("Profile() error = %v, want invalid serialized textures", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Profile() unexpected error: %v", err)
+			}
+			if profile.Textures == nil {
+				t.Fatal("Profile() returned nil textures map")
+			}
+			if profile.Textures["SKIN"] != tt.wantSkin {
+				t.Errorf("SKIN = %q, want %q", profile.Textures["SKIN"], tt.wantSkin)
+			}
+		})
+	}
+}
+
+func TestSetProfileValidatesTextures(t *testing.T) {
+	tests := []struct {
+		name     string
+		textures map[string]string
+		wantErr  string
+	}{
+		{name: "valid", textures: map[string]string{"SKIN": "abcdef", "SKIN_HD": "0123", "CAPE": "ff", "ELYTRA": "00"}},
+		{name: "unknown type", textures: map[string]string{"HAT": "abcdef"}, wantErr: "invalid texture type"},
+		{name: "lowercase type", textures: map[string]string{"skin": "abcdef"}, wantErr: "invalid texture type"},
+		{name: "empty hash", textures: map[string]string{"SKIN": ""}, wantErr: "invalid texture hash for SKIN"},
+		{name: "non-hex hash", textures: map[string]string{"CAPE": "../etc/passwd"}, wantErr: "invalid texture hash for CAPE"},
+		{name: "hash too long", textures: map[string]string{"SKIN": strings.Repeat("a", 66)}, wantErr: "invalid texture hash for SKIN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := User{ID: uuid.New(), ProfileName: "Tester"}
+			profile, err := NewProfile(user.ID, user.ProfileName, STEVE, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			profile.Textures = tt.textures
+			err = user.SetProfile(&profile)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("SetProfile() unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("SetProfile() error = %v, want %q", err, tt.wantErr)
+			}
+			if len(user.SerializedTextures) != 0 {
+				t.Errorf("invalid textures were stored: %s", user.SerializedTextures)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package model
+
+import "github.com/google/uuid"
+
+// UserTexture 用户当前使用的材质, 与 User.SerializedTextures 保持一致, 用于按用户或按材质查询
+type UserTexture struct {
+	UserID      uuid.UUID `gorm:"type:string;size:36;primaryKey"`
+	TextureType string    `gorm:"size:8;primaryKey"`
+	Hash        string    `gorm:"size:64;not null;index:user_texture_hash_idx"`
+}
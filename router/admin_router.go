@@ -0,0 +1,222 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package router
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"log"
+	"net/http"
+	"time"
+	"yggdrasil-go/service"
+	"yggdrasil-go/util"
+)
+
+type AdminRouter interface {
+	ListUsers(c *gin.Context)
+	ListPendingUsers(c *gin.Context)
+	ApproveUser(c *gin.Context)
+	RejectUser(c *gin.Context)
+	RevokeTokens(c *gin.Context)
+	VerifyTextures(c *gin.Context)
+	TextureHistory(c *gin.Context)
+	CreateInviteCode(c *gin.Context)
+	ListInviteCodes(c *gin.Context)
+	RevokeInviteCode(c *gin.Context)
+	GetRegistration(c *gin.Context)
+	SetRegistration(c *gin.Context)
+}
+
+type adminRouterImpl struct {
+	adminService service.AdminService
+}
+
+func NewAdminRouter(adminService service.AdminService) AdminRouter {
+	adminRouter := adminRouterImpl{
+		adminService: adminService,
+	}
+	return &adminRouter
+}
+
+type ListUsersRequest struct {
+	Page     int    `form:"page" binding:"omitempty,min=1"`
+	PageSize int    `form:"pageSize" binding:"omitempty,min=1"`
+	Pending  *bool  `form:"pending"`
+	Search   string `form:"q" binding:"max=64"`
+}
+
+func (a *adminRouterImpl) ListUsers(c *gin.Context) {
+	request := ListUsersRequest{}
+	err := c.ShouldBindQuery(&request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewBindingError(err))
+		return
+	}
+	response, err := a.adminService.ListUsers(service.UserQuery{
+		Page:     request.Page,
+		PageSize: request.PageSize,
+		Pending:  request.Pending,
+		Search:   request.Search,
+	})
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (a *adminRouterImpl) ListPendingUsers(c *gin.Context) {
+	response, err := a.adminService.ListPendingUsers()
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (a *adminRouterImpl) ApproveUser(c *gin.Context) {
+	userId, err := util.ToUUID(c.Param("uuid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewIllegalArgumentError(err.Error()))
+		return
+	}
+	err = a.adminService.ApproveUser(userId)
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (a *adminRouterImpl) RejectUser(c *gin.Context) {
+	userId, err := util.ToUUID(c.Param("uuid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewIllegalArgumentError(err.Error()))
+		return
+	}
+	err = a.adminService.RejectUser(userId)
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+type RevokeTokensResponse struct {
+	Revoked int `json:"revoked"`
+}
+
+func (a *adminRouterImpl) RevokeTokens(c *gin.Context) {
+	var profileId *uuid.UUID
+	if profileIdStr := c.Param("uuid"); len(profileIdStr) > 0 {
+		id, err := util.ToUUID(profileIdStr)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, util.NewIllegalArgumentError(err.Error()))
+			return
+		}
+		profileId = &id
+	}
+	revoked := a.adminService.RevokeTokens(profileId)
+	c.JSON(http.StatusOK, RevokeTokensResponse{Revoked: revoked})
+}
+
+func (a *adminRouterImpl) VerifyTextures(c *gin.Context) {
+	response, err := a.adminService.VerifyTextures()
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+type RegistrationState struct {
+	Open *bool `json:"open" binding:"required"`
+}
+
+func (a *adminRouterImpl) GetRegistration(c *gin.Context) {
+	open := service.RegistrationOpen()
+	c.JSON(http.StatusOK, RegistrationState{Open: &open})
+}
+
+// SetRegistration 在运行时开放或关闭注册, 重启或 SIGHUP 后恢复为配置文件中的值
+func (a *adminRouterImpl) SetRegistration(c *gin.Context) {
+	request := RegistrationState{}
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewBindingError(err))
+		return
+	}
+	service.SetRegistrationOpen(*request.Open)
+	log.Printf("管理员修改了注册状态, 开放注册: %t\n", *request.Open)
+	c.JSON(http.StatusOK, request)
+}
+
+func (a *adminRouterImpl) TextureHistory(c *gin.Context) {
+	userId, err := util.ToUUID(c.Param("uuid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewIllegalArgumentError(err.Error()))
+		return
+	}
+	response, err := a.adminService.TextureHistory(userId)
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+type CreateInviteCodeRequest struct {
+	MaxUses   int        `json:"maxUses" binding:"omitempty,min=1"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+func (a *adminRouterImpl) CreateInviteCode(c *gin.Context) {
+	request := CreateInviteCodeRequest{}
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewBindingError(err))
+		return
+	}
+	if request.MaxUses == 0 {
+		request.MaxUses = 1
+	}
+	response, err := a.adminService.CreateInviteCode(request.MaxUses, request.ExpiresAt)
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, response)
+}
+
+func (a *adminRouterImpl) ListInviteCodes(c *gin.Context) {
+	response, err := a.adminService.ListInviteCodes()
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (a *adminRouterImpl) RevokeInviteCode(c *gin.Context) {
+	err := a.adminService.RevokeInviteCode(c.Param("code"))
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"strings"
+	"yggdrasil-go/util"
+)
+
+// debugLogPaths 记录请求/响应内容的接口路径前缀
+var debugLogPaths = []string{"/authserver/", "/sessionserver/", "/minecraftservices/", "/api/profiles/"}
+
+// redactedFields 记录日志时隐藏的 JSON 字段, 不区分大小写
+var redactedFields = map[string]bool{
+	"password":    true,
+	"accesstoken": true,
+	"clienttoken": true,
+	"privatekey":  true,
+}
+
+type bodyCaptureWriter struct {
+	gin.ResponseWriter
+	body  bytes.Buffer
+	limit int
+}
+
+func (w *bodyCaptureWriter) Write(data []byte) (int, error) {
+	if remaining := w.limit + 1 - w.body.Len(); remaining > 0 {
+		if len(data) < remaining {
+			remaining = len(data)
+		}
+		w.body.Write(data[:remaining])
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// DebugBodyLogger 调试用: 记录认证、会话接口的请求和响应内容, 密码和令牌会被隐藏, 超过 maxBytes 的内容不记录
+func DebugBodyLogger(maxBytes int) gin.HandlerFunc {
+	log.Println("警告: 已开启请求内容调试日志, 请勿在生产环境中长期开启")
+	return func(c *gin.Context) {
+		if !shouldDebugLog(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+		var requestBody []byte
+		if c.Request.Body != nil {
+			requestBody, _ = io.ReadAll(io.LimitReader(c.Request.Body, int64(maxBytes)+1))
+			c.Request.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(requestBody), c.Request.Body), c.Request.Body}
+		}
+		writer := &bodyCaptureWriter{ResponseWriter: c.Writer, limit: maxBytes}
+		c.Writer = writer
+		c.Next()
+		log.Printf("[DEBUG] %s | %s %s | 请求: %s | 响应 %d: %s\n",
+			c.GetString(util.RequestIdKey),
+			c.Request.Method,
+			c.Request.URL.RequestURI(),
+			redactBody(requestBody, maxBytes),
+			writer.Status(),
+			redactBody(writer.body.Bytes(), maxBytes),
+		)
+	}
+}
+
+func shouldDebugLog(path string) bool {
+	for _, prefix := range debugLogPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactBody 隐藏 JSON 中的敏感字段, 无法解析或超长的内容只记录长度
+func redactBody(body []byte, maxBytes int) string {
+	if len(body) == 0 {
+		return "<empty>"
+	}
+	if len(body) > maxBytes {
+		return fmt.Sprintf("<%d+ bytes>", maxBytes)
+	}
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return fmt.Sprintf("<%d bytes>", len(body))
+	}
+	redacted, err := json.Marshal(redactValue(value))
+	if err != nil {
+		return fmt.Sprintf("<%d bytes>", len(body))
+	}
+	return string(redacted)
+}
+
+func redactValue(value interface{}) interface{} {
+	switch x := value.(type) {
+	case map[string]interface{}:
+		for key, item := range x {
+			if redactedFields[strings.ToLower(key)] {
+				x[key] = "***"
+			} else {
+				x[key] = redactValue(item)
+			}
+		}
+	case []interface{}:
+		for i, item := range x {
+			x[i] = redactValue(item)
+		}
+	}
+	return value
+}
@@ -22,6 +22,9 @@ import (
 	"encoding/pem"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"sort"
+	"strings"
+	"yggdrasil-go/service"
 	"yggdrasil-go/util"
 )
 
@@ -37,12 +40,18 @@ type MetaInfo struct {
 	FeatureLegacySkinApi     bool `json:"feature.legacy_skin_api,omitempty"`
 	FeatureNoMojangNamespace bool `json:"feature.no_mojang_namespace,omitempty"`
 	FeatureEnableProfileKey  bool `json:"feature.enable_profile_key,omitempty"`
+	// FeatureEnableMojangAntiFeatures 开启后客户端会请求玩家权限、屏蔽列表等接口, 并启用聊天举报等功能
+	FeatureEnableMojangAntiFeatures bool `json:"feature.enable_mojang_anti_features,omitempty"`
 }
 
 type ServerMeta struct {
 	Meta               MetaInfo `json:"meta"`
 	SkinDomains        []string `json:"skinDomains"`
 	SignaturePublickey string   `json:"signaturePublickey"`
+	// Extra 规范以外的附加信息 (如联系方式、服务条款地址), 放在单独的键下, 遵循规范的客户端会忽略
+	Extra map[string]interface{} `json:"x-extra,omitempty"`
+	// ExtraRegistrationOpen 在 Extra 中附带当前是否开放注册
+	ExtraRegistrationOpen bool `json:"-"`
 }
 
 type KeyPair struct {
@@ -55,28 +64,129 @@ type PublicKeys struct {
 	PlayerCertificateKeys []KeyPair `json:"playerCertificateKeys,omitempty"`
 }
 
+type Endpoint struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+// ServerInfo 机器可读的服务端能力描述
+type ServerInfo struct {
+	ImplementationName    string          `json:"implementationName"`
+	ImplementationVersion string          `json:"implementationVersion"`
+	ServerName            string          `json:"serverName"`
+	Features              map[string]bool `json:"features"`
+	SkinDomains           []string        `json:"skinDomains"`
+	Endpoints             []Endpoint      `json:"endpoints"`
+}
+
+// Status 供服务器列表网站使用的简要状态
+type Status struct {
+	ServerName       string `json:"serverName"`
+	Version          string `json:"version"`
+	Online           bool   `json:"online"`
+	Players          int64  `json:"players"`
+	Maintenance      bool   `json:"maintenance"`
+	RegistrationOpen bool   `json:"registrationOpen"`
+}
+
 type HomeRouter interface {
 	Home(c *gin.Context)
+	Status(c *gin.Context)
 	PublicKeys(c *gin.Context)
+	Metrics(c *gin.Context)
+	ServerInfo(c *gin.Context)
+	SetRoutes(routes gin.RoutesInfo)
 }
 
 type homeRouterImpl struct {
-	serverMeta ServerMeta
-	myPubKey   KeyPair
+	statusService service.StatusService
+	serverMeta    ServerMeta
+	myPubKey      KeyPair
+	serverInfo    ServerInfo
 }
 
-func NewHomeRouter(meta *ServerMeta) HomeRouter {
+func NewHomeRouter(statusService service.StatusService, meta *ServerMeta) HomeRouter {
 	signaturePubKey, _ := pem.Decode([]byte(meta.SignaturePublickey))
 	homeRouter := homeRouterImpl{
-		serverMeta: *meta,
-		myPubKey:   KeyPair{PublicKey: base64.StdEncoding.EncodeToString(signaturePubKey.Bytes)},
+		statusService: statusService,
+		serverMeta:    *meta,
+		myPubKey:      KeyPair{PublicKey: base64.StdEncoding.EncodeToString(signaturePubKey.Bytes)},
 	}
 	return &homeRouter
 }
 
 // Home 首页路由
 func (h *homeRouterImpl) Home(c *gin.Context) {
-	c.JSON(http.StatusOK, h.serverMeta)
+	if !h.serverMeta.ExtraRegistrationOpen {
+		c.JSON(http.StatusOK, h.serverMeta)
+		return
+	}
+	// 注册状态可在运行时修改, 每次请求时复制一份附加信息
+	response := h.serverMeta
+	response.Extra = make(map[string]interface{}, len(h.serverMeta.Extra)+1)
+	for k, v := range h.serverMeta.Extra {
+		response.Extra[k] = v
+	}
+	response.Extra["registrationOpen"] = service.RegistrationOpen()
+	c.JSON(http.StatusOK, response)
+}
+
+func (h *homeRouterImpl) Status(c *gin.Context) {
+	players, err := h.statusService.PlayerCount(c.ClientIP())
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=30")
+	c.JSON(http.StatusOK, Status{
+		ServerName:       h.serverMeta.Meta.ServerName,
+		Version:          h.serverMeta.Meta.ImplementationVersion,
+		Online:           true,
+		Players:          players,
+		Maintenance:      InMaintenance(),
+		RegistrationOpen: service.RegistrationOpen(),
+	})
+}
+
+func (h *homeRouterImpl) ServerInfo(c *gin.Context) {
+	c.JSON(http.StatusOK, h.serverInfo)
+}
+
+// SetRoutes 根据已注册的路由生成服务端能力描述, 应在注册完所有路由后调用
+func (h *homeRouterImpl) SetRoutes(routes gin.RoutesInfo) {
+	meta := h.serverMeta.Meta
+	endpoints := make([]Endpoint, 0, len(routes))
+	for _, route := range routes {
+		if isInternalRoute(route.Path) {
+			continue
+		}
+		endpoints = append(endpoints, Endpoint{Method: route.Method, Path: route.Path})
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].Path != endpoints[j].Path {
+			return endpoints[i].Path < endpoints[j].Path
+		}
+		return endpoints[i].Method < endpoints[j].Method
+	})
+	h.serverInfo = ServerInfo{
+		ImplementationName:    meta.ImplementationName,
+		ImplementationVersion: meta.ImplementationVersion,
+		ServerName:            meta.ServerName,
+		Features: map[string]bool{
+			"non_email_login":             meta.FeatureNonEmailLogin,
+			"legacy_skin_api":             meta.FeatureLegacySkinApi,
+			"no_mojang_namespace":         meta.FeatureNoMojangNamespace,
+			"enable_profile_key":          meta.FeatureEnableProfileKey,
+			"enable_mojang_anti_features": meta.FeatureEnableMojangAntiFeatures,
+		},
+		SkinDomains: h.serverMeta.SkinDomains,
+		Endpoints:   endpoints,
+	}
+}
+
+// isInternalRoute 管理接口和监控接口不对外公布
+func isInternalRoute(path string) bool {
+	return path == "/metrics" || path == "/admin" || strings.HasPrefix(path, "/admin/")
 }
 
 func (h *homeRouterImpl) PublicKeys(c *gin.Context) {
@@ -90,3 +200,9 @@ func (h *homeRouterImpl) PublicKeys(c *gin.Context) {
 	publicKeys.PlayerCertificateKeys = append(publicKeys.PlayerCertificateKeys, h.myPubKey)
 	c.JSON(http.StatusOK, publicKeys)
 }
+
+func (h *homeRouterImpl) Metrics(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	_ = util.WriteMetrics(c.Writer)
+}
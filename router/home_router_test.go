@@ -0,0 +1,138 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package router
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"yggdrasil-go/service"
+)
+
+func TestSetRoutesHidesInternalRoutes(t *testing.T) {
+	h := homeRouterImpl{}
+	h.SetRoutes(gin.RoutesInfo{
+		{Method: "GET", Path: "/"},
+		{Method: "GET", Path: "/status"},
+		{Method: "GET", Path: "/metrics"},
+		{Method: "POST", Path: "/authserver/authenticate"},
+		{Method: "GET", Path: "/admin/users"},
+		{Method: "PUT", Path: "/admin/registration"},
+		{Method: "GET", Path: "/administrator"},
+	})
+	want := []Endpoint{
+		{Method: "GET", Path: "/"},
+		{Method: "GET", Path: "/administrator"},
+		{Method: "POST", Path: "/authserver/authenticate"},
+		{Method: "GET", Path: "/status"},
+	}
+	got := h.serverInfo.Endpoints
+	if len(got) != len(want) {
+		t.Fatalf("Endpoints = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Endpoints[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestHomeExtraCannotOverrideMeta(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	meta := ServerMeta{
+		SkinDomains:        []string{"skin.example.com"},
+		SignaturePublickey: "-----BEGIN PUBLIC KEY-----\nMIIB\n-----END PUBLIC KEY-----\n",
+		// 与 [meta_extra] 配置节相同, 所有值均为字符串
+		Extra: map[string]interface{}{
+			"contact":                     "admin@example.com",
+			"serverName":                  "Spoofed",
+			"implementationName":          "spoofed-impl",
+			"feature.non_email_login":     "false",
+			"feature.enable_profile_key":  "false",
+			"feature.no_mojang_namespace": "true",
+			"meta":                        "spoofed",
+			"skinDomains":                 "spoofed.example.com",
+			"signaturePublickey":          "spoofed",
+			"registrationOpen":            "spoofed",
+		},
+	}
+	meta.Meta.ServerName = "Test Server"
+	meta.Meta.ImplementationName = "yggdrasil-go"
+	meta.Meta.ImplementationVersion = "v1.0.0"
+	meta.Meta.FeatureNonEmailLogin = true
+	meta.Meta.FeatureEnableProfileKey = true
+	wantMeta := map[string]interface{}{
+		"serverName":                 "Test Server",
+		"implementationName":         "yggdrasil-go",
+		"implementationVersion":      "v1.0.0",
+		"links":                      map[string]interface{}{},
+		"feature.non_email_login":    true,
+		"feature.enable_profile_key": true,
+	}
+
+	for _, registrationOpen := range []bool{false, true} {
+		meta.ExtraRegistrationOpen = registrationOpen
+		h := homeRouterImpl{serverMeta: meta}
+		r := gin.New()
+		r.GET("/", h.Home)
+		service.SetRegistrationOpen(true)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+		response := map[string]interface{}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(response) != 4 {
+			t.Errorf("top-level keys = %v, want meta, skinDomains, signaturePublickey and x-extra", response)
+		}
+		if !reflect.DeepEqual(response["meta"], wantMeta) {
+			t.Errorf("meta = %v, want %v", response["meta"], wantMeta)
+		}
+		if !reflect.DeepEqual(response["skinDomains"], []interface{}{"skin.example.com"}) {
+			t.Errorf("skinDomains = %v", response["skinDomains"])
+		}
+		if response["signaturePublickey"] != meta.SignaturePublickey {
+			t.Errorf("signaturePublickey = %v, want %q", response["signaturePublickey"], meta.SignaturePublickey)
+		}
+		// 附加信息原样放在 x-extra 下, 开启 extra_registration_open 时 registrationOpen 为实际状态
+		extra, _ := response["x-extra"].(map[string]interface{})
+		for key, value := range meta.Extra {
+			want := value
+			if key == "registrationOpen" && registrationOpen {
+				want = true
+			}
+			if extra[key] != want {
+				t.Errorf("x-extra[%q] = %v, want %v", key, extra[key], want)
+			}
+		}
+		if len(extra) != len(meta.Extra) {
+			t.Errorf("x-extra = %v, want %d keys", extra, len(meta.Extra))
+		}
+	}
+	// 每次请求复制附加信息, 不修改配置中的原始值
+	if meta.Extra["registrationOpen"] != "spoofed" {
+		t.Errorf("configured extra modified: %v", meta.Extra)
+	}
+}
@@ -18,39 +18,51 @@
 package router
 
 import (
-	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
 	"gorm.io/gorm"
-	"time"
+	"reflect"
+	"strings"
 	"yggdrasil-go/service"
 )
 
-func InitRouters(router *gin.Engine, db *gorm.DB, meta *ServerMeta, skinRootUrl string) {
-	router.Use(cors.New(cors.Config{
-		AllowAllOrigins:  true,
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "HEAD"},
-		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "User-Agent"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
-	}))
+type ServiceCfg struct {
+	Token     service.TokenCfg
+	User      service.UserCfg
+	Session   service.SessionCfg
+	RateLimit service.RateLimitCfg
+	Texture   service.TextureCfg
+	Admin     service.AdminCfg
+	Cache     service.CacheCfg
+	Mojang    service.MojangCfg
+}
+
+func InitRouters(router *gin.Engine, db *gorm.DB, meta *ServerMeta, skinRootUrls SkinRootUrls, cfg ServiceCfg) {
+	useJsonFieldNames()
 
-	tokenService := service.NewTokenService()
-	userService := service.NewUserService(tokenService, db)
-	sessionService := service.NewSessionService(tokenService)
-	textureService := service.NewTextureService(tokenService, db)
-	homeRouter := NewHomeRouter(meta)
-	userRouter := NewUserRouter(userService, skinRootUrl)
-	sessionRouter := NewSessionRouter(sessionService, skinRootUrl)
-	textureRouter := NewTextureRouter(textureService)
+	tokenService := service.NewTokenService(cfg.Token, cfg.Cache)
+	mojangClient := service.NewMojangClient(cfg.Mojang)
+	profileCache := service.NewProfileCache(cfg.Cache)
+	userService := service.NewUserService(tokenService, mojangClient, profileCache, db, cfg.User, cfg.RateLimit, cfg.Texture, cfg.Cache)
+	sessionService := service.NewSessionService(tokenService, cfg.Session, cfg.Texture, cfg.Cache)
+	textureService := service.NewTextureService(tokenService, profileCache, db, cfg.Texture)
+	statusService := service.NewStatusService(db, cfg.RateLimit, cfg.Cache)
+	homeRouter := NewHomeRouter(statusService, meta)
+	userRouter := NewUserRouter(userService, skinRootUrls)
+	sessionRouter := NewSessionRouter(sessionService, skinRootUrls)
+	textureRouter := NewTextureRouter(textureService, cfg.Texture)
 
 	router.GET("/", homeRouter.Home)
 	router.HEAD("/", homeRouter.Home)
+	router.GET("/status", homeRouter.Status)
+	router.GET("/metrics", homeRouter.Metrics)
+	router.GET("/.well-known/yggdrasil", homeRouter.ServerInfo)
 	authserver := router.Group("/authserver")
 	{
-		authserver.POST("/register", userRouter.Register)
+		authserver.POST("/register", RejectInMaintenance, userRouter.Register)
 		authserver.POST("/authenticate", userRouter.Login)
-		authserver.POST("/change", userRouter.ChangeProfile)
+		authserver.POST("/change", RejectInMaintenance, userRouter.ChangeProfile)
 		authserver.POST("/refresh", userRouter.Refresh)
 		authserver.POST("/validate", userRouter.Validate)
 		authserver.POST("/invalidate", userRouter.Invalidate)
@@ -60,6 +72,7 @@ func InitRouters(router *gin.Engine, db *gorm.DB, meta *ServerMeta, skinRootUrl
 	sessionserver := router.Group("/sessionserver/session/minecraft")
 	{
 		sessionserver.GET("/profile/:uuid", userRouter.QueryProfile)
+		sessionserver.GET("/profile/by-name/:username", userRouter.QueryProfileByName)
 		sessionserver.POST("/join", sessionRouter.JoinServer)
 		sessionserver.GET("/hasJoined", sessionRouter.HasJoinedServer)
 	}
@@ -67,14 +80,56 @@ func InitRouters(router *gin.Engine, db *gorm.DB, meta *ServerMeta, skinRootUrl
 	api := router.Group("/api")
 	{
 		api.POST("/profiles/minecraft", userRouter.QueryUUIDs)
-		api.POST("/user/profile/:uuid/:textureType", textureRouter.SetTexture)
-		api.PUT("/user/profile/:uuid/:textureType", textureRouter.UploadTexture)
-		api.DELETE("/user/profile/:uuid/:textureType", textureRouter.DeleteTexture)
+		api.POST("/profiles/minecraft/full", userRouter.QueryProfiles)
+		api.POST("/user/profile/:uuid/:textureType", RejectInMaintenance, textureRouter.SetTexture)
+		api.PUT("/user/profile/:uuid/:textureType", RejectInMaintenance, textureRouter.UploadTexture)
+		api.DELETE("/user/profile/:uuid/:textureType", RejectInMaintenance, textureRouter.DeleteTexture)
+		api.GET("/user/profile/:uuid/history", textureRouter.TextureHistory)
 		api.GET("/users/profiles/minecraft/:username", userRouter.UsernameToUUID)
+		api.GET("/user/token/info", userRouter.TokenInfo)
+		api.DELETE("/user/certificates", userRouter.RevokeProfileKey)
+		api.GET("/user/export", userRouter.ExportProfile)
+		api.PUT("/user/blocklist/:uuid", userRouter.BlockPlayer)
+		api.DELETE("/user/blocklist/:uuid", userRouter.UnblockPlayer)
 	}
 	minecraftservices := router.Group("/minecraftservices")
 	{
 		minecraftservices.POST("/player/certificates", userRouter.ProfileKey)
+		minecraftservices.GET("/player/attributes", userRouter.PlayerAttributes)
+		minecraftservices.GET("/privacy/blocklist", userRouter.BlockList)
 		minecraftservices.GET("/publickeys", homeRouter.PublicKeys)
 	}
+	if len(cfg.Admin.Token) > 0 {
+		adminRouter := NewAdminRouter(service.NewAdminService(tokenService, profileCache, db, cfg.Admin))
+		admin := router.Group("/admin", AdminAuth(cfg.Admin.Token))
+		{
+			admin.GET("/users", adminRouter.ListUsers)
+			admin.GET("/users/pending", adminRouter.ListPendingUsers)
+			admin.POST("/users/:uuid/approve", adminRouter.ApproveUser)
+			admin.POST("/users/:uuid/reject", adminRouter.RejectUser)
+			admin.GET("/users/:uuid/textures/history", adminRouter.TextureHistory)
+			admin.DELETE("/tokens", adminRouter.RevokeTokens)
+			admin.DELETE("/tokens/:uuid", adminRouter.RevokeTokens)
+			admin.POST("/textures/verify", adminRouter.VerifyTextures)
+			admin.POST("/invite-codes", adminRouter.CreateInviteCode)
+			admin.GET("/invite-codes", adminRouter.ListInviteCodes)
+			admin.DELETE("/invite-codes/:code", adminRouter.RevokeInviteCode)
+			admin.GET("/registration", adminRouter.GetRegistration)
+			admin.PUT("/registration", adminRouter.SetRegistration)
+		}
+	}
+	homeRouter.SetRoutes(router.Routes())
+}
+
+// useJsonFieldNames 使校验错误中使用 JSON 字段名
+func useJsonFieldNames() {
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(field reflect.StructField) string {
+			name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+			if name == "-" {
+				return ""
+			}
+			return name
+		})
+	}
 }
@@ -0,0 +1,246 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package router
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+	"yggdrasil-go/util"
+)
+
+const RequestIdHeader = "X-Request-Id"
+
+// RequestId 为每个请求附加请求 ID, 优先使用客户端传入的 X-Request-Id
+func RequestId() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestId := c.GetHeader(RequestIdHeader)
+		if !isValidRequestId(requestId) {
+			requestId = util.RandomUUID()
+		}
+		c.Set(util.RequestIdKey, requestId)
+		c.Header(RequestIdHeader, requestId)
+		c.Next()
+	}
+}
+
+// Cors 允许任意来源跨域访问, 并暴露请求 ID 响应头
+func Cors() gin.HandlerFunc {
+	return cors.New(cors.Config{
+		AllowAllOrigins:  true,
+		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "HEAD"},
+		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "User-Agent", RequestIdHeader},
+		ExposeHeaders:    []string{"Content-Length", RequestIdHeader},
+		AllowCredentials: true,
+		MaxAge:           12 * time.Hour,
+	})
+}
+
+func isValidRequestId(requestId string) bool {
+	if len(requestId) == 0 || len(requestId) > 64 {
+		return false
+	}
+	for _, r := range requestId {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// LogFormatter 在 gin 默认日志格式的基础上输出请求 ID
+func LogFormatter(param gin.LogFormatterParams) string {
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %s | %-7s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		param.ClientIP,
+		param.Keys[util.RequestIdKey],
+		param.Method,
+		param.Path,
+		param.ErrorMessage,
+	)
+}
+
+var inFlightRequests int64
+
+// TrackInFlight 统计正在处理的请求数, 供关闭服务时输出日志
+func TrackInFlight(c *gin.Context) {
+	atomic.AddInt64(&inFlightRequests, 1)
+	defer atomic.AddInt64(&inFlightRequests, -1)
+	c.Next()
+}
+
+// InFlightRequests 返回正在处理的请求数
+func InFlightRequests() int64 {
+	return atomic.LoadInt64(&inFlightRequests)
+}
+
+// ConcurrencyLimit 限制同时处理的请求数量, 超出时返回 503;
+// exemptPaths 中的路径 (如 /metrics, /status) 不受限制, 保证服务繁忙时监控和健康检查仍可用
+func ConcurrencyLimit(maxConcurrent int, exemptPaths []string) gin.HandlerFunc {
+	sem := make(chan struct{}, maxConcurrent)
+	exempt := make(map[string]bool, len(exemptPaths))
+	for _, path := range exemptPaths {
+		exempt[path] = true
+	}
+	util.RegisterGauge("yggdrasil_http_requests_in_flight", "Number of HTTP requests currently being served.", func() float64 {
+		return float64(len(sem))
+	})
+	util.RegisterGauge("yggdrasil_http_requests_max_concurrent", "Maximum number of concurrent HTTP requests.", func() float64 {
+		return float64(maxConcurrent)
+	})
+	return func(c *gin.Context) {
+		if exempt[c.Request.URL.Path] {
+			c.Next()
+			return
+		}
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			c.Next()
+		default:
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, util.YggdrasilError{
+				ErrorCode:    "ServiceUnavailableException",
+				ErrorMessage: "Server is busy, please try again later.",
+			})
+		}
+	}
+}
+
+var maintenance int32
+
+func init() {
+	util.RegisterGauge("yggdrasil_maintenance_mode", "Whether maintenance mode is enabled (1) or not (0).", func() float64 {
+		return float64(atomic.LoadInt32(&maintenance))
+	})
+}
+
+// SetMaintenance 开启或关闭维护模式, 维护模式下拒绝所有写操作
+func SetMaintenance(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&maintenance, value)
+}
+
+func InMaintenance() bool {
+	return atomic.LoadInt32(&maintenance) == 1
+}
+
+// RejectInMaintenance 维护模式下拒绝写操作请求
+func RejectInMaintenance(c *gin.Context) {
+	if InMaintenance() {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, util.YggdrasilError{
+			ErrorCode:    "ServiceUnavailableException",
+			ErrorMessage: "Server is under maintenance, please try again later.",
+		})
+		return
+	}
+	c.Next()
+}
+
+// AdminAuth 校验管理接口的 Bearer 令牌
+func AdminAuth(token string) gin.HandlerFunc {
+	expected := []byte("Bearer " + token)
+	return func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), expected) != 1 {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, util.NewForbiddenOperationError(util.MessageAccessDenied))
+			return
+		}
+		c.Next()
+	}
+}
+
+type prettyJsonWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *prettyJsonWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *prettyJsonWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+// PrettyJSON 以缩进格式输出 JSON 响应, always 为 false 时仅对带有 pretty 参数的请求生效
+func PrettyJSON(always bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.GetQuery("pretty"); !always && !ok {
+			c.Next()
+			return
+		}
+		writer := &prettyJsonWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+		c.Writer = writer.ResponseWriter
+		body := writer.body.Bytes()
+		if strings.HasPrefix(writer.Header().Get("Content-Type"), "application/json") {
+			var indented bytes.Buffer
+			if err := json.Indent(&indented, body, "", "  "); err == nil {
+				indented.WriteByte('\n')
+				body = indented.Bytes()
+			}
+		}
+		if len(body) > 0 {
+			_, _ = writer.ResponseWriter.Write(body)
+		}
+	}
+}
+
+// NoRoute 未匹配的路径: spaPrefix 下的 GET 请求返回前端页面, 其他路径返回 JSON 格式的 404 错误
+func NoRoute(spaPrefix string, indexFile string) gin.HandlerFunc {
+	spaPrefix = strings.TrimRight(spaPrefix, "/")
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		if len(spaPrefix) > 0 && c.Request.Method == http.MethodGet && (path == spaPrefix || strings.HasPrefix(path, spaPrefix+"/")) {
+			c.File(indexFile)
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusNotFound, util.YggdrasilError{
+			ErrorCode:    "Not Found",
+			ErrorMessage: "The server has not found anything matching the request URI",
+		})
+	}
+}
+
+// bearerToken 从 Authorization 头中取出令牌, scheme 不区分大小写;
+// 缺失或格式错误时返回 401 并设置 WWW-Authenticate
+func bearerToken(c *gin.Context) (string, bool) {
+	token, err := util.ExtractBearerToken(c.GetHeader("Authorization"))
+	if err == nil {
+		return token, true
+	}
+	c.Header("WWW-Authenticate", "Bearer")
+	c.AbortWithStatusJSON(http.StatusUnauthorized, util.NewForbiddenOperationError(util.MessageInvalidToken))
+	return "", false
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"yggdrasil-go/service"
+	"yggdrasil-go/util"
+)
+
+func TestConcurrencyLimitExemptPaths(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(RequestId(), ConcurrencyLimit(1, []string{"/metrics", "/status"}))
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	r.GET("/slow", func(c *gin.Context) {
+		close(entered)
+		<-release
+		c.Status(http.StatusOK)
+	})
+	for _, path := range []string{"/fast", "/status", "/metrics"} {
+		r.GET(path, func(c *gin.Context) { c.Status(http.StatusOK) })
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+	}()
+	<-entered
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/fast", http.StatusServiceUnavailable},
+		{"/status", http.StatusOK},
+		{"/metrics", http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("GET %s = %d, want %d", tt.path, w.Code, tt.want)
+		}
+		if w.Header().Get(RequestIdHeader) == "" {
+			t.Errorf("GET %s response missing %s", tt.path, RequestIdHeader)
+		}
+	}
+	close(release)
+	<-done
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /fast after release = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestNoRoute(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	indexFile := filepath.Join(t.TempDir(), "index.html")
+	if err := os.WriteFile(indexFile, []byte("<html>spa</html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.NoRoute(NoRoute("/profile/", indexFile))
+
+	tests := []struct {
+		method   string
+		path     string
+		wantCode int
+		wantSpa  bool
+	}{
+		{http.MethodGet, "/api/unknown", http.StatusNotFound, false},
+		{http.MethodPost, "/authserver/unknown", http.StatusNotFound, false},
+		{http.MethodGet, "/profiles", http.StatusNotFound, false},
+		{http.MethodGet, "/profile", http.StatusOK, true},
+		{http.MethodGet, "/profile/", http.StatusOK, true},
+		{http.MethodGet, "/profile/user/settings", http.StatusOK, true},
+		// 前端页面只响应 GET 请求
+		{http.MethodPost, "/profile/user", http.StatusNotFound, false},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.wantCode {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.path, w.Code, tt.wantCode)
+			continue
+		}
+		if tt.wantSpa {
+			if w.Body.String() != "<html>spa</html>" {
+				t.Errorf("%s %s body = %q, want index file", tt.method, tt.path, w.Body.String())
+			}
+			continue
+		}
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+			t.Errorf("%s %s content type = %q, want JSON", tt.method, tt.path, w.Header().Get("Content-Type"))
+		}
+		response := util.YggdrasilError{}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || response.ErrorCode != "Not Found" {
+			t.Errorf("%s %s body = %s, want JSON Not Found error", tt.method, tt.path, w.Body.String())
+		}
+	}
+}
+
+func TestCustomRemoteIPHeader(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useJsonFieldNames()
+	services := newTestServices(t, service.UserCfg{RegisterLimitPerIp: 1}, service.TextureCfg{}, nil)
+	r := gin.New()
+	// 与 main.go 相同的配置方式: 只信任反向代理所在网段转发的自定义请求头
+	r.RemoteIPHeaders = []string{"X-Client-IP"}
+	if err := r.SetTrustedProxies([]string{"192.0.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	userRouter := NewUserRouter(services.user, SkinRootUrls{})
+	sessionRouter := NewSessionRouter(services.session, SkinRootUrls{})
+	r.POST("/authserver/register", userRouter.Register)
+	r.POST("/sessionserver/session/minecraft/join", sessionRouter.JoinServer)
+	r.GET("/sessionserver/session/minecraft/hasJoined", sessionRouter.HasJoinedServer)
+
+	serve := func(method string, path string, body string, remoteAddr string, headers map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+	service.SetRegistrationOpen(true)
+	register := func(i int, remoteAddr string, headers map[string]string) int {
+		body := fmt.Sprintf(`{"username":"user%d@example.com","password":"password","profileName":"Player%d"}`, i, i)
+		return serve(http.MethodPost, "/authserver/register", body, remoteAddr, headers).Code
+	}
+
+	registrations := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		wantStatus int
+	}{
+		{"first from client", "192.0.2.10:40000", map[string]string{"X-Client-IP": "203.0.113.5"}, http.StatusOK},
+		{"same client via another proxy", "192.0.2.11:40000", map[string]string{"X-Client-IP": "203.0.113.5"}, http.StatusTooManyRequests},
+		// 未配置的 X-Forwarded-For 不参与计算
+		{"unconfigured header ignored", "192.0.2.10:40000", map[string]string{"X-Client-IP": "203.0.113.5", "X-Forwarded-For": "203.0.113.9"}, http.StatusTooManyRequests},
+		{"another client", "192.0.2.10:40000", map[string]string{"X-Client-IP": "203.0.113.6"}, http.StatusOK},
+		// 来自不受信任地址的请求头被忽略, 使用连接地址
+		{"untrusted proxy", "198.51.100.1:40000", map[string]string{"X-Client-IP": "203.0.113.5"}, http.StatusOK},
+	}
+	for i, tt := range registrations {
+		if got := register(i, tt.remoteAddr, tt.headers); got != tt.wantStatus {
+			t.Errorf("%s: register status = %d, want %d", tt.name, got, tt.wantStatus)
+		}
+	}
+
+	login, err := services.user.Login("user0@example.com", "password", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(`{"accessToken":%q,"selectedProfile":%q,"serverId":"server-1"}`, login.AccessToken, login.SelectedProfile.Id)
+	if w := serve(http.MethodPost, "/sessionserver/session/minecraft/join", body, "192.0.2.10:40000", map[string]string{"X-Client-IP": "203.0.113.5"}); w.Code != http.StatusNoContent {
+		t.Fatalf("join status = %d, want %d, body = %s", w.Code, http.StatusNoContent, w.Body.String())
+	}
+	hasJoined := []struct {
+		ip         string
+		wantStatus int
+	}{
+		{"192.0.2.10", http.StatusNoContent},
+		{"203.0.113.6", http.StatusNoContent},
+		{"203.0.113.5", http.StatusOK},
+	}
+	for _, tt := range hasJoined {
+		path := "/sessionserver/session/minecraft/hasJoined?username=Player0&serverId=server-1&ip=" + tt.ip
+		if w := serve(http.MethodGet, path, "", "192.0.2.20:40000", nil); w.Code != tt.wantStatus {
+			t.Errorf("hasJoined ip=%s status = %d, want %d", tt.ip, w.Code, tt.wantStatus)
+		}
+	}
+}
@@ -20,7 +20,6 @@ package router
 import (
 	"github.com/gin-gonic/gin"
 	"net/http"
-	"strings"
 	"yggdrasil-go/service"
 	"yggdrasil-go/util"
 )
@@ -32,13 +31,13 @@ type SessionRouter interface {
 
 type sessionRouterImpl struct {
 	sessionService service.SessionService
-	skinRootUrl    string
+	skinRootUrls   SkinRootUrls
 }
 
-func NewSessionRouter(sessionService service.SessionService, skinRootUrl string) SessionRouter {
+func NewSessionRouter(sessionService service.SessionService, skinRootUrls SkinRootUrls) SessionRouter {
 	sessionRouter := sessionRouterImpl{
 		sessionService: sessionService,
-		skinRootUrl:    skinRootUrl,
+		skinRootUrls:   skinRootUrls,
 	}
 	return &sessionRouter
 }
@@ -53,7 +52,7 @@ func (s *sessionRouterImpl) JoinServer(c *gin.Context) {
 	request := JoinServerRequest{}
 	err := c.ShouldBindJSON(&request)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusForbidden, util.NewForbiddenOperationError(err.Error()))
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewBindingError(err))
 		return
 	}
 	ip := c.ClientIP()
@@ -69,13 +68,7 @@ func (s *sessionRouterImpl) HasJoinedServer(c *gin.Context) {
 	username := c.Query("username")
 	serverId := c.Query("serverId")
 	ip := c.Query("ip")
-	var textureBaseUrl string
-	if len(s.skinRootUrl) > 0 {
-		textureBaseUrl = strings.TrimRight(s.skinRootUrl, "/") + "/textures"
-	} else {
-		textureBaseUrl = c.Request.URL.Scheme + "://" + c.Request.URL.Hostname() + "/textures"
-	}
-	response, err := s.sessionService.HasJoinedServer(serverId, username, ip, textureBaseUrl)
+	response, err := s.sessionService.HasJoinedServer(serverId, username, ip, textureBaseUrl(c, s.skinRootUrls.Select(c)))
 	if err != nil {
 		util.HandleError(c, err)
 		return
@@ -18,6 +18,7 @@
 package router
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"yggdrasil-go/model"
@@ -30,14 +31,19 @@ type TextureRouter interface {
 	SetTexture(c *gin.Context)
 	UploadTexture(c *gin.Context)
 	DeleteTexture(c *gin.Context)
+	TextureHistory(c *gin.Context)
 }
 
 type textureRouterImpl struct {
 	textureService service.TextureService
+	textureCfg     service.TextureCfg
 }
 
-func NewTextureRouter(textureService service.TextureService) TextureRouter {
-	textureRouter := textureRouterImpl{textureService: textureService}
+func NewTextureRouter(textureService service.TextureService, textureCfg service.TextureCfg) TextureRouter {
+	textureRouter := textureRouterImpl{
+		textureService: textureService,
+		textureCfg:     textureCfg,
+	}
 	return &textureRouter
 }
 
@@ -54,6 +60,7 @@ func (t *textureRouterImpl) GetTexture(c *gin.Context) {
 		return
 	}
 	c.Header("Cache-Control", "public, max-age=31536000")
+	c.Header("Content-Disposition", `inline; filename="`+hash+`.png"`)
 	c.Data(http.StatusOK, "image/png", response)
 }
 
@@ -61,22 +68,20 @@ func (t *textureRouterImpl) SetTexture(c *gin.Context) {
 	request := SetTextureRequest{Model: string(model.STEVE)}
 	err := c.ShouldBindJSON(&request)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusForbidden, util.NewForbiddenOperationError(err.Error()))
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewBindingError(err))
 		return
 	}
-	bearerToken := c.GetHeader("Authorization")
-	if len(bearerToken) < 8 {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, util.NewForbiddenOperationError(util.MessageInvalidToken))
+	accessToken, ok := bearerToken(c)
+	if !ok {
 		return
 	}
-	accessToken := bearerToken[7:]
 	profileId, err := util.ToUUID(c.Param("uuid"))
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewIllegalArgumentError(err.Error()))
 		return
 	}
 	textureType := c.Param("textureType")
-	if textureType != "skin" && textureType != "cape" {
+	if !t.textureCfg.IsUploadable(textureType) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewIllegalArgumentError("Invalid texture type."))
 		return
 	}
@@ -93,19 +98,17 @@ func (t *textureRouterImpl) SetTexture(c *gin.Context) {
 }
 
 func (t *textureRouterImpl) UploadTexture(c *gin.Context) {
-	bearerToken := c.GetHeader("Authorization")
-	if len(bearerToken) < 8 {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, util.NewForbiddenOperationError(util.MessageInvalidToken))
+	accessToken, ok := bearerToken(c)
+	if !ok {
 		return
 	}
-	accessToken := bearerToken[7:]
 	profileId, err := util.ToUUID(c.Param("uuid"))
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewIllegalArgumentError(err.Error()))
 		return
 	}
 	textureType := c.Param("textureType")
-	if textureType != "skin" && textureType != "cape" {
+	if !t.textureCfg.IsUploadable(textureType) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewIllegalArgumentError("Invalid texture type."))
 		return
 	}
@@ -119,8 +122,8 @@ func (t *textureRouterImpl) UploadTexture(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewIllegalArgumentError(err.Error()))
 		return
 	}
-	if file.Size > (1 << 20) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewIllegalArgumentError("File too large(more than 1MiB)"))
+	if maxBytes := t.textureCfg.MaxBytes(textureType); file.Size > maxBytes {
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewIllegalArgumentError(fmt.Sprintf("File too large(more than %d bytes)", maxBytes)))
 		return
 	}
 	fileReader, err := file.Open()
@@ -141,19 +144,17 @@ func (t *textureRouterImpl) UploadTexture(c *gin.Context) {
 }
 
 func (t *textureRouterImpl) DeleteTexture(c *gin.Context) {
-	bearerToken := c.GetHeader("Authorization")
-	if len(bearerToken) < 8 {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, util.NewForbiddenOperationError(util.MessageInvalidToken))
+	accessToken, ok := bearerToken(c)
+	if !ok {
 		return
 	}
-	accessToken := bearerToken[7:]
 	profileId, err := util.ToUUID(c.Param("uuid"))
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewIllegalArgumentError(err.Error()))
 		return
 	}
 	textureType := c.Param("textureType")
-	if textureType != "skin" && textureType != "cape" {
+	if !t.textureCfg.IsUploadable(textureType) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewIllegalArgumentError("Invalid texture type."))
 		return
 	}
@@ -164,3 +165,21 @@ func (t *textureRouterImpl) DeleteTexture(c *gin.Context) {
 	}
 	c.Status(http.StatusNoContent)
 }
+
+func (t *textureRouterImpl) TextureHistory(c *gin.Context) {
+	accessToken, ok := bearerToken(c)
+	if !ok {
+		return
+	}
+	profileId, err := util.ToUUID(c.Param("uuid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewIllegalArgumentError(err.Error()))
+		return
+	}
+	response, err := t.textureService.TextureHistory(accessToken, profileId)
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
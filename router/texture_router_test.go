@@ -0,0 +1,114 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package router
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"yggdrasil-go/service"
+	"yggdrasil-go/util"
+)
+
+func TestUploadableTextures(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useJsonFieldNames()
+	tests := []struct {
+		name           string
+		uploadable     []string
+		wantCape       bool
+		wantUploadable string
+	}{
+		{"capes disabled", []string{"skin"}, false, "skin"},
+		{"capes enabled", []string{"skin", "cape"}, true, "skin,cape"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			textureCfg := service.TextureCfg{UploadableTextures: tt.uploadable, AllowedImageTypes: []string{"png"}}
+			services := newTestServices(t, service.UserCfg{}, textureCfg, nil)
+			login := registerTestUser(t, services.user, "test@example.com", "Tester")
+			textureRouter := NewTextureRouter(services.texture, textureCfg)
+			r := gin.New()
+			r.POST("/api/user/profile/:uuid/:textureType", textureRouter.SetTexture)
+			r.PUT("/api/user/profile/:uuid/:textureType", textureRouter.UploadTexture)
+			r.DELETE("/api/user/profile/:uuid/:textureType", textureRouter.DeleteTexture)
+			r.GET("/sessionserver/session/minecraft/profile/by-name/:username", NewUserRouter(services.user, SkinRootUrls{}).QueryProfileByName)
+
+			path := "/api/user/profile/" + login.SelectedProfile.Id + "/"
+			serve := func(method string, textureType string, body string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest(method, path+textureType, strings.NewReader(body))
+				req.Header.Set("Authorization", "Bearer "+login.AccessToken)
+				if body != "" {
+					req.Header.Set("Content-Type", "application/json")
+				}
+				r.ServeHTTP(w, req)
+				return w
+			}
+
+			// 不允许的类型在调用材质服务之前即被拒绝; 允许的类型交由服务处理, 此处角色没有材质也无法下载, 返回其他错误
+			requests := []struct {
+				method string
+				body   string
+			}{
+				{http.MethodPost, `{"url":"http://127.0.0.1:1/texture.png"}`},
+				{http.MethodPut, ""},
+				{http.MethodDelete, ""},
+			}
+			for _, textureType := range []string{"skin", "cape"} {
+				allowed := textureType == "skin" || tt.wantCape
+				for _, request := range requests {
+					w := serve(request.method, textureType, request.body)
+					response := util.YggdrasilError{}
+					_ = json.Unmarshal(w.Body.Bytes(), &response)
+					rejected := w.Code == http.StatusBadRequest && response.ErrorMessage == "Invalid texture type."
+					if rejected == allowed {
+						t.Errorf("%s %s status = %d, body = %s, want rejected = %v", request.method, textureType, w.Code, w.Body.String(), !allowed)
+					}
+				}
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sessionserver/session/minecraft/profile/by-name/Tester?unsigned=true", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("profile status = %d, want %d", w.Code, http.StatusOK)
+			}
+			profile := struct {
+				Properties []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"properties"`
+			}{}
+			if err := json.Unmarshal(w.Body.Bytes(), &profile); err != nil {
+				t.Fatal(err)
+			}
+			uploadable := ""
+			for _, property := range profile.Properties {
+				if property.Name == "uploadableTextures" {
+					uploadable = property.Value
+				}
+			}
+			if uploadable != tt.wantUploadable {
+				t.Errorf("uploadableTextures = %q, want %q", uploadable, tt.wantUploadable)
+			}
+		})
+	}
+}
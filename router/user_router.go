@@ -20,6 +20,7 @@ package router
 import (
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"net/url"
 	"strings"
 	"yggdrasil-go/model"
 	"yggdrasil-go/service"
@@ -37,18 +38,27 @@ type UserRouter interface {
 	UsernameToUUID(c *gin.Context)
 	QueryUUIDs(c *gin.Context)
 	QueryProfile(c *gin.Context)
+	QueryProfileByName(c *gin.Context)
+	QueryProfiles(c *gin.Context)
 	ProfileKey(c *gin.Context)
+	TokenInfo(c *gin.Context)
+	RevokeProfileKey(c *gin.Context)
+	ExportProfile(c *gin.Context)
+	PlayerAttributes(c *gin.Context)
+	BlockList(c *gin.Context)
+	BlockPlayer(c *gin.Context)
+	UnblockPlayer(c *gin.Context)
 }
 
 type userRouterImpl struct {
-	userService service.UserService
-	skinRootUrl string
+	userService  service.UserService
+	skinRootUrls SkinRootUrls
 }
 
-func NewUserRouter(userService service.UserService, skinRootUrl string) UserRouter {
+func NewUserRouter(userService service.UserService, skinRootUrls SkinRootUrls) UserRouter {
 	userRouter := userRouterImpl{
-		userService: userService,
-		skinRootUrl: skinRootUrl,
+		userService:  userService,
+		skinRootUrls: skinRootUrls,
 	}
 	return &userRouter
 }
@@ -57,6 +67,8 @@ type RegRequest struct {
 	Username    string `json:"username" binding:"required,email"`
 	Password    string `json:"password" binding:"required"`
 	ProfileName string `json:"profileName" binding:"required"`
+	// InviteCode 开启邀请注册 (require_invite_code) 时必填
+	InviteCode string `json:"inviteCode" binding:"max=32"`
 }
 
 type MinecraftAgent struct {
@@ -109,14 +121,85 @@ type SignoutRequest struct {
 	Password string `json:"password" binding:"required"`
 }
 
+// SkinRootUrls 材质访问地址, 可根据请求头的值为不同客户端或网络选择不同的地址
+type SkinRootUrls struct {
+	Default string
+	// Header 用于选择地址的请求头, 为 Host 时使用请求的 Host, 为空时始终使用 Default
+	Header   string
+	ByHeader map[string]string
+}
+
+func (s SkinRootUrls) Select(c *gin.Context) string {
+	if len(s.Header) == 0 {
+		return s.Default
+	}
+	var value string
+	if strings.EqualFold(s.Header, "Host") {
+		value = c.Request.Host
+	} else {
+		value = c.GetHeader(s.Header)
+	}
+	if skinRootUrl, ok := s.ByHeader[value]; ok {
+		return skinRootUrl
+	}
+	return s.Default
+}
+
+// Uncovered 返回域名不在 skinDomains 白名单中的材质地址, 客户端会拒绝加载这些地址上的材质;
+// 以 . 开头的条目匹配其所有子域名, 否则要求域名完全相同
+func (s SkinRootUrls) Uncovered(skinDomains []string) []string {
+	skinRootUrls := []string{s.Default}
+	for _, skinRootUrl := range s.ByHeader {
+		skinRootUrls = append(skinRootUrls, skinRootUrl)
+	}
+	var uncovered []string
+	for _, skinRootUrl := range skinRootUrls {
+		if len(skinRootUrl) == 0 {
+			continue
+		}
+		parsed, err := url.Parse(skinRootUrl)
+		if err != nil || !hostInSkinDomains(parsed.Hostname(), skinDomains) {
+			uncovered = append(uncovered, skinRootUrl)
+		}
+	}
+	return uncovered
+}
+
+func hostInSkinDomains(host string, skinDomains []string) bool {
+	host = strings.ToLower(host)
+	for _, domain := range skinDomains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if strings.HasPrefix(domain, ".") {
+			if strings.HasSuffix(host, domain) {
+				return true
+			}
+		} else if host == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// textureBaseUrl 材质访问地址前缀, 未配置 skinRootUrl 时根据请求推断
+func textureBaseUrl(c *gin.Context, skinRootUrl string) string {
+	if len(skinRootUrl) > 0 {
+		return strings.TrimRight(skinRootUrl, "/") + "/textures"
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host + "/textures"
+}
+
 func (u *userRouterImpl) Register(c *gin.Context) {
 	request := RegRequest{}
 	err := c.ShouldBindJSON(&request)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusForbidden, util.NewForbiddenOperationError(err.Error()))
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewBindingError(err))
 		return
 	}
-	response, err := u.userService.Register(request.Username, request.Password, request.ProfileName)
+	response, err := u.userService.Register(request.Username, request.Password, request.ProfileName, request.InviteCode, c.ClientIP())
 	if err != nil {
 		util.HandleError(c, err)
 		return
@@ -128,7 +211,7 @@ func (u *userRouterImpl) Login(c *gin.Context) {
 	request := LoginRequest{}
 	err := c.ShouldBindJSON(&request)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusForbidden, util.NewForbiddenOperationError(err.Error()))
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewBindingError(err))
 		return
 	}
 	response, err := u.userService.Login(request.Username, request.Password, request.ClientToken, request.RequestUser)
@@ -143,7 +226,7 @@ func (u *userRouterImpl) ChangeProfile(c *gin.Context) {
 	request := ChangeProfileRequest{}
 	err := c.ShouldBindJSON(&request)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusForbidden, util.NewForbiddenOperationError(err.Error()))
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewBindingError(err))
 		return
 	}
 	err = u.userService.ChangeProfile(request.AccessToken, request.ClientToken, request.ChangeTo)
@@ -158,7 +241,7 @@ func (u *userRouterImpl) Refresh(c *gin.Context) {
 	request := RefreshRequest{}
 	err := c.ShouldBindJSON(&request)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusForbidden, util.NewForbiddenOperationError(err.Error()))
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewBindingError(err))
 		return
 	}
 	response, err := u.userService.Refresh(request.AccessToken, request.ClientToken, request.RequestUser, request.SelectedProfile)
@@ -173,7 +256,7 @@ func (u *userRouterImpl) Validate(c *gin.Context) {
 	request := ValidateRequest{}
 	err := c.ShouldBindJSON(&request)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusForbidden, util.NewForbiddenOperationError(err.Error()))
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewBindingError(err))
 		return
 	}
 	err = u.userService.Validate(request.AccessToken, request.ClientToken)
@@ -188,7 +271,7 @@ func (u *userRouterImpl) Invalidate(c *gin.Context) {
 	request := InvalidateRequest{}
 	err := c.ShouldBindJSON(&request)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusForbidden, util.NewForbiddenOperationError(err.Error()))
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewBindingError(err))
 		return
 	}
 	err = u.userService.Invalidate(request.AccessToken)
@@ -203,7 +286,7 @@ func (u *userRouterImpl) Signout(c *gin.Context) {
 	request := SignoutRequest{}
 	err := c.ShouldBindJSON(&request)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusForbidden, util.NewForbiddenOperationError(err.Error()))
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewBindingError(err))
 		return
 	}
 	err = u.userService.Signout(request.Username, request.Password)
@@ -228,11 +311,25 @@ func (u *userRouterImpl) UsernameToUUID(c *gin.Context) {
 	}
 }
 
+// BulkLookupResponse 批量查询接口带 detailed=true 参数时的响应, 包含每个角色名的查询结果
+type BulkLookupResponse struct {
+	Results []service.BulkLookupResult `json:"results"`
+}
+
 func (u *userRouterImpl) QueryUUIDs(c *gin.Context) {
 	var request []string
 	err := c.ShouldBindJSON(&request)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusForbidden, util.NewForbiddenOperationError(err.Error()))
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewBindingError(err))
+		return
+	}
+	if "true" == c.DefaultQuery("detailed", "false") {
+		results, err := u.userService.QueryUUIDsDetailed(request)
+		if err != nil {
+			util.HandleError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, BulkLookupResponse{Results: results})
 		return
 	}
 	response, err := u.userService.QueryUUIDs(request)
@@ -251,13 +348,57 @@ func (u *userRouterImpl) QueryProfile(c *gin.Context) {
 		return
 	}
 	unsigned := "true" == c.DefaultQuery("unsigned", "false")
-	var textureBaseUrl string
-	if len(u.skinRootUrl) > 0 {
-		textureBaseUrl = strings.TrimRight(u.skinRootUrl, "/") + "/textures"
-	} else {
-		textureBaseUrl = c.Request.URL.Scheme + "://" + c.Request.URL.Hostname() + "/textures"
+	response, err := u.userService.QueryProfile(profileId, unsigned, textureBaseUrl(c, u.skinRootUrls.Select(c)))
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// QueryProfileByName 按角色名查询完整的角色信息, 角色不存在时返回 204
+func (u *userRouterImpl) QueryProfileByName(c *gin.Context) {
+	profile, err := u.userService.UsernameToUUID(c.Param("username"))
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	if profile == nil {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	profileId, err := util.ToUUID(profile.Id)
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	unsigned := "true" == c.DefaultQuery("unsigned", "false")
+	response, err := u.userService.QueryProfile(profileId, unsigned, textureBaseUrl(c, u.skinRootUrls.Select(c)))
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (u *userRouterImpl) QueryProfiles(c *gin.Context) {
+	var request []string
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewBindingError(err))
+		return
+	}
+	unsigned := "true" == c.DefaultQuery("unsigned", "false")
+	if "true" == c.DefaultQuery("detailed", "false") {
+		results, err := u.userService.QueryProfilesDetailed(request, unsigned, textureBaseUrl(c, u.skinRootUrls.Select(c)))
+		if err != nil {
+			util.HandleError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, BulkLookupResponse{Results: results})
+		return
 	}
-	response, err := u.userService.QueryProfile(profileId, unsigned, textureBaseUrl)
+	response, err := u.userService.QueryProfiles(request, unsigned, textureBaseUrl(c, u.skinRootUrls.Select(c)))
 	if err != nil {
 		util.HandleError(c, err)
 		return
@@ -266,12 +407,10 @@ func (u *userRouterImpl) QueryProfile(c *gin.Context) {
 }
 
 func (u *userRouterImpl) ProfileKey(c *gin.Context) {
-	bearerToken := c.GetHeader("Authorization")
-	if len(bearerToken) < 8 {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, util.NewForbiddenOperationError(util.MessageInvalidToken))
+	accessToken, ok := bearerToken(c)
+	if !ok {
 		return
 	}
-	accessToken := bearerToken[7:]
 	response, err := u.userService.ProfileKey(accessToken)
 	if err != nil {
 		util.HandleError(c, err)
@@ -279,3 +418,104 @@ func (u *userRouterImpl) ProfileKey(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, response)
 }
+
+func (u *userRouterImpl) TokenInfo(c *gin.Context) {
+	accessToken, ok := bearerToken(c)
+	if !ok {
+		return
+	}
+	response, err := u.userService.TokenInfo(accessToken)
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (u *userRouterImpl) RevokeProfileKey(c *gin.Context) {
+	accessToken, ok := bearerToken(c)
+	if !ok {
+		return
+	}
+	err := u.userService.RevokeProfileKey(accessToken)
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (u *userRouterImpl) ExportProfile(c *gin.Context) {
+	accessToken, ok := bearerToken(c)
+	if !ok {
+		return
+	}
+	response, err := u.userService.ExportProfile(accessToken, textureBaseUrl(c, u.skinRootUrls.Select(c)))
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (u *userRouterImpl) PlayerAttributes(c *gin.Context) {
+	accessToken, ok := bearerToken(c)
+	if !ok {
+		return
+	}
+	response, err := u.userService.PlayerAttributes(accessToken)
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (u *userRouterImpl) BlockList(c *gin.Context) {
+	accessToken, ok := bearerToken(c)
+	if !ok {
+		return
+	}
+	response, err := u.userService.BlockList(accessToken)
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (u *userRouterImpl) BlockPlayer(c *gin.Context) {
+	accessToken, ok := bearerToken(c)
+	if !ok {
+		return
+	}
+	blockedId, err := util.ToUUID(c.Param("uuid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewIllegalArgumentError(err.Error()))
+		return
+	}
+	err = u.userService.BlockPlayer(accessToken, blockedId)
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (u *userRouterImpl) UnblockPlayer(c *gin.Context) {
+	accessToken, ok := bearerToken(c)
+	if !ok {
+		return
+	}
+	blockedId, err := util.ToUUID(c.Param("uuid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, util.NewIllegalArgumentError(err.Error()))
+		return
+	}
+	err = u.userService.UnblockPlayer(accessToken, blockedId)
+	if err != nil {
+		util.HandleError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,294 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"yggdrasil-go/model"
+	"yggdrasil-go/service"
+	"yggdrasil-go/util"
+)
+
+// fakeMojangClient 模拟 Mojang 接口, 所有角色名均不存在, err 不为 nil 时模拟网络错误
+type fakeMojangClient struct {
+	err error
+}
+
+func (f *fakeMojangClient) UsernameToUUID(string) (model.ProfileResponse, error) {
+	if f.err != nil {
+		return model.ProfileResponse{}, f.err
+	}
+	return model.ProfileResponse{}, util.YggdrasilError{Status: http.StatusNotFound, ErrorCode: "Not Found"}
+}
+
+func (f *fakeMojangClient) UsernamesToUUIDs(usernames []string) ([]model.ProfileResponse, map[string]error) {
+	errs := make(map[string]error)
+	if f.err != nil {
+		for _, username := range usernames {
+			errs[username] = f.err
+		}
+	}
+	return nil, errs
+}
+
+func (f *fakeMojangClient) QueryProfile(uuid.UUID, bool) (map[string]interface{}, error) {
+	return nil, util.YggdrasilError{Status: http.StatusNoContent}
+}
+
+func (f *fakeMojangClient) Refresh(string, *string, bool, *model.ProfileResponse) (*service.LoginResponse, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *fakeMojangClient) Validate(string, *string) error {
+	return errors.New("not implemented")
+}
+
+func (f *fakeMojangClient) Invalidate(string) error {
+	return errors.New("not implemented")
+}
+
+func (f *fakeMojangClient) ProfileKey(string) (*service.ProfileKeyResponse, error) {
+	return nil, errors.New("not implemented")
+}
+
+// testServices 共用同一个数据库和令牌服务的各项服务
+type testServices struct {
+	user    service.UserService
+	texture service.TextureService
+	session service.SessionService
+}
+
+// newTestServices 使用独立的内存 sqlite 数据库创建各项服务, cfg 中未设置的 BcryptCost 和 UuidStrategy 使用测试默认值
+func newTestServices(t *testing.T, cfg service.UserCfg, textureCfg service.TextureCfg, mojangClient service.MojangClient) testServices {
+	t.Helper()
+	dsn := "file:router_" + strings.ReplaceAll(t.Name(), "/", "_") + "?mode=memory&cache=shared"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = sqlDB.Close() })
+	err = db.AutoMigrate(&model.User{}, &model.Texture{}, &model.UserTexture{}, &model.Block{}, &model.InviteCode{}, &model.TextureHistory{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.BcryptCost == 0 {
+		cfg.BcryptCost = bcrypt.MinCost
+	}
+	if cfg.UuidStrategy == "" {
+		cfg.UuidStrategy = "random"
+	}
+	if mojangClient == nil {
+		mojangClient = &fakeMojangClient{}
+	}
+	cacheCfg := service.DefaultCacheCfg()
+	tokenService := service.NewTokenService(service.TokenCfg{
+		ValidDuration:   model.DefaultTokenValidDuration,
+		RefreshDuration: model.DefaultTokenRefreshDuration,
+	}, cacheCfg)
+	profileCache := service.NewProfileCache(cacheCfg)
+	return testServices{
+		user:    service.NewUserService(tokenService, mojangClient, profileCache, db, cfg, service.RateLimitCfg{}, textureCfg, cacheCfg),
+		texture: service.NewTextureService(tokenService, profileCache, db, textureCfg),
+		session: service.NewSessionService(tokenService, service.SessionCfg{}, textureCfg, cacheCfg),
+	}
+}
+
+// registerTestUser 注册用户并登录, 返回登录结果
+func registerTestUser(t *testing.T, userService service.UserService, email string, profileName string) *service.LoginResponse {
+	t.Helper()
+	service.SetRegistrationOpen(true)
+	if _, err := userService.Register(email, "password", profileName, "", "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	response, err := userService.Login(email, "password", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestRegisterBindingError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useJsonFieldNames()
+	r := gin.New()
+	// 请求在绑定阶段即被拒绝, 不会调用 userService
+	r.POST("/authserver/register", NewUserRouter(nil, SkinRootUrls{}).Register)
+
+	tests := []struct {
+		name    string
+		body    string
+		wantMsg string
+	}{
+		{"missing fields", `{}`, "Invalid fields: username(required), password(required), profileName(required)"},
+		{"invalid email", `{"username":"not-an-email","password":"123456","profileName":"Tester"}`, "Invalid fields: username(email)"},
+		{"invite code too long", `{"username":"a@example.com","password":"123456","profileName":"Tester","inviteCode":"` + strings.Repeat("x", 33) + `"}`, "Invalid fields: inviteCode(max=32)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/authserver/register", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+			}
+			response := util.YggdrasilError{}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.ErrorCode != "IllegalArgumentException" || response.ErrorMessage != tt.wantMsg {
+				t.Errorf("response = %+v, want IllegalArgumentException %q", response, tt.wantMsg)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/authserver/register", strings.NewReader(`{"username":`))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("malformed JSON status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestBearerTokenMalformedAuthorization(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useJsonFieldNames()
+	userService := newTestServices(t, service.UserCfg{}, service.TextureCfg{}, nil).user
+	login := registerTestUser(t, userService, "test@example.com", "Tester")
+	r := gin.New()
+	r.GET("/api/user/token/info", NewUserRouter(userService, SkinRootUrls{}).TokenInfo)
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+	}{
+		{"missing header", "", http.StatusUnauthorized},
+		{"missing scheme", login.AccessToken, http.StatusUnauthorized},
+		{"scheme without token", "Bearer", http.StatusUnauthorized},
+		{"scheme with blank token", "Bearer   ", http.StatusUnauthorized},
+		{"unsupported scheme", "Basic " + login.AccessToken, http.StatusUnauthorized},
+		{"lowercase scheme", "bearer " + login.AccessToken, http.StatusOK},
+		{"canonical scheme", "Bearer " + login.AccessToken, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/api/user/token/info", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			r.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body = %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantStatus == http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("WWW-Authenticate"); got != "Bearer" {
+				t.Errorf("WWW-Authenticate = %q, want %q", got, "Bearer")
+			}
+			response := util.YggdrasilError{}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.ErrorCode != "ForbiddenOperationException" || response.ErrorMessage != util.MessageInvalidToken {
+				t.Errorf("response = %+v, want ForbiddenOperationException %q", response, util.MessageInvalidToken)
+			}
+		})
+	}
+}
+
+func TestQueryProfileByName(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useJsonFieldNames()
+	tests := []struct {
+		name   string
+		mojang *fakeMojangClient
+	}{
+		{"mojang not found", &fakeMojangClient{}},
+		{"mojang unavailable", &fakeMojangClient{err: errors.New("connection refused")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userService := newTestServices(t, service.UserCfg{}, service.TextureCfg{}, tt.mojang).user
+			login := registerTestUser(t, userService, "test@example.com", "Tester")
+			r := gin.New()
+			r.GET("/sessionserver/session/minecraft/profile/by-name/:username", NewUserRouter(userService, SkinRootUrls{}).QueryProfileByName)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sessionserver/session/minecraft/profile/by-name/Tester?unsigned=true", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("found status = %d, want %d, body = %s", w.Code, http.StatusOK, w.Body.String())
+			}
+			response := struct {
+				Id         string `json:"id"`
+				Name       string `json:"name"`
+				Properties []struct {
+					Name      string `json:"name"`
+					Value     string `json:"value"`
+					Signature string `json:"signature"`
+				} `json:"properties"`
+			}{}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Id != login.SelectedProfile.Id || response.Name != "Tester" {
+				t.Errorf("profile = %s %s, want %s Tester", response.Id, response.Name, login.SelectedProfile.Id)
+			}
+			hasTextures := false
+			for _, property := range response.Properties {
+				if property.Signature != "" {
+					t.Errorf("property %s is signed in unsigned response", property.Name)
+				}
+				if property.Name == "textures" && property.Value != "" {
+					hasTextures = true
+				}
+			}
+			if !hasTextures {
+				t.Errorf("properties = %+v, want textures", response.Properties)
+			}
+
+			w = httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sessionserver/session/minecraft/profile/by-name/Nobody", nil))
+			if w.Code != http.StatusNoContent {
+				t.Errorf("absent status = %d, want %d", w.Code, http.StatusNoContent)
+			}
+			if w.Body.Len() != 0 {
+				t.Errorf("absent body = %q, want empty", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,336 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"image/png"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"yggdrasil-go/model"
+	"yggdrasil-go/util"
+)
+
+type AdminService interface {
+	ListUsers(query UserQuery) (*UserListResponse, error)
+	ListPendingUsers() ([]AdminUserResponse, error)
+	ApproveUser(userId uuid.UUID) error
+	RejectUser(userId uuid.UUID) error
+	RevokeTokens(profileId *uuid.UUID) int
+	VerifyTextures() (*TextureVerifyResponse, error)
+	CreateInviteCode(maxUses int, expiresAt *time.Time) (*InviteCodeResponse, error)
+	ListInviteCodes() ([]InviteCodeResponse, error)
+	RevokeInviteCode(code string) error
+	TextureHistory(userId uuid.UUID) ([]TextureHistoryEntry, error)
+}
+
+type AdminCfg struct {
+	// Token 管理接口的访问令牌, 为空时不启用管理接口
+	Token string `ini:"token"`
+	// DefaultPageSize 用户列表默认每页数量
+	DefaultPageSize int `ini:"default_page_size"`
+	// MaxPageSize 用户列表每页最大数量
+	MaxPageSize int `ini:"max_page_size"`
+}
+
+type AdminUserResponse struct {
+	Id          string    `json:"id"`
+	Email       string    `json:"email"`
+	ProfileName string    `json:"profileName"`
+	Pending     bool      `json:"pending"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// UserQuery 用户列表的分页和筛选条件
+type UserQuery struct {
+	Page     int
+	PageSize int
+	// Pending 不为 nil 时只返回审核状态与之相同的用户
+	Pending *bool
+	// Search 按邮箱或角色名模糊搜索
+	Search string
+}
+
+type UserListResponse struct {
+	Total    int64               `json:"total"`
+	Page     int                 `json:"page"`
+	PageSize int                 `json:"pageSize"`
+	Users    []AdminUserResponse `json:"users"`
+}
+
+type InviteCodeResponse struct {
+	Code      string     `json:"code"`
+	MaxUses   int        `json:"maxUses"`
+	Used      int        `json:"used"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+type TextureMismatch struct {
+	Hash string `json:"hash"`
+	// Computed 由图像内容重新计算出的材质 ID, 无法解码时为空
+	Computed string `json:"computed,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type TextureVerifyResponse struct {
+	Checked    int               `json:"checked"`
+	Mismatches []TextureMismatch `json:"mismatches"`
+}
+
+type adminServiceImpl struct {
+	tokenService TokenService
+	profileCache ProfileCache
+	db           *gorm.DB
+	cfg          AdminCfg
+}
+
+func NewAdminService(tokenService TokenService, profileCache ProfileCache, db *gorm.DB, cfg AdminCfg) AdminService {
+	adminService := adminServiceImpl{
+		tokenService: tokenService,
+		profileCache: profileCache,
+		db:           db,
+		cfg:          cfg,
+	}
+	return &adminService
+}
+
+func (a *adminServiceImpl) ListUsers(query UserQuery) (*UserListResponse, error) {
+	if query.Page < 1 {
+		query.Page = 1
+	}
+	if query.PageSize < 1 {
+		query.PageSize = a.cfg.DefaultPageSize
+	}
+	if query.PageSize > a.cfg.MaxPageSize {
+		query.PageSize = a.cfg.MaxPageSize
+	}
+	tx := a.db.Model(&model.User{})
+	if query.Pending != nil {
+		tx = tx.Where("pending = ?", *query.Pending)
+	}
+	if len(query.Search) > 0 {
+		pattern := "%" + likeEscaper.Replace(query.Search) + "%"
+		tx = tx.Where("email LIKE ? ESCAPE '!' OR profile_name LIKE ? ESCAPE '!'", pattern, pattern)
+	}
+	response := UserListResponse{
+		Page:     query.Page,
+		PageSize: query.PageSize,
+	}
+	if err := tx.Count(&response.Total).Error; err != nil {
+		return nil, err
+	}
+	var users []model.User
+	if err := tx.Order("created_at").Offset((query.Page - 1) * query.PageSize).Limit(query.PageSize).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	response.Users = make([]AdminUserResponse, 0, len(users))
+	for _, user := range users {
+		response.Users = append(response.Users, toAdminUserResponse(user))
+	}
+	return &response, nil
+}
+
+func (a *adminServiceImpl) ListPendingUsers() ([]AdminUserResponse, error) {
+	var users []model.User
+	if err := a.db.Where("pending = ?", true).Order("created_at").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	response := make([]AdminUserResponse, 0, len(users))
+	for _, user := range users {
+		response = append(response, toAdminUserResponse(user))
+	}
+	return response, nil
+}
+
+func (a *adminServiceImpl) ApproveUser(userId uuid.UUID) error {
+	result := a.db.Model(&model.User{}).Where("id = ? AND pending = ?", userId, true).Update("pending", false)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return pendingUserNotFound()
+	}
+	log.Printf("管理员审核通过用户 %s\n", userId.String())
+	return nil
+}
+
+// RejectUser 拒绝注册申请并删除该账号, 以释放邮箱和角色名
+func (a *adminServiceImpl) RejectUser(userId uuid.UUID) error {
+	result := a.db.Where("id = ? AND pending = ?", userId, true).Delete(&model.User{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return pendingUserNotFound()
+	}
+	a.profileCache.Invalidate(userId)
+	log.Printf("管理员拒绝用户 %s 的注册申请\n", userId.String())
+	return nil
+}
+
+// RevokeTokens 吊销指定角色的所有令牌, profileId 为 nil 时吊销全部令牌
+func (a *adminServiceImpl) RevokeTokens(profileId *uuid.UUID) int {
+	if profileId == nil {
+		revoked := a.tokenService.Purge()
+		log.Printf("管理员吊销了全部 %d 个令牌\n", revoked)
+		return revoked
+	}
+	revoked := a.tokenService.RemoveAll(*profileId)
+	log.Printf("管理员吊销了角色 %s 的 %d 个令牌\n", profileId.String(), revoked)
+	return revoked
+}
+
+func pendingUserNotFound() error {
+	return util.YggdrasilError{
+		Status:       http.StatusNotFound,
+		ErrorCode:    "Not Found",
+		ErrorMessage: "No such pending user.",
+	}
+}
+
+// likeEscaper 转义 LIKE 模式中的通配符, 配合 ESCAPE '!' 使用
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+func toAdminUserResponse(user model.User) AdminUserResponse {
+	return AdminUserResponse{
+		Id:          util.UnsignedString(user.ID),
+		Email:       user.Email,
+		ProfileName: user.ProfileName,
+		Pending:     user.Pending,
+		CreatedAt:   user.CreatedAt,
+	}
+}
+
+// VerifyTextures 重新计算每个材质图像的 ID 并与存储的 Hash 比较, 用于发现存储损坏或去重错误
+func (a *adminServiceImpl) VerifyTextures() (*TextureVerifyResponse, error) {
+	response := TextureVerifyResponse{Mismatches: make([]TextureMismatch, 0)}
+	var textures []model.Texture
+	err := a.db.Select("hash", "data").FindInBatches(&textures, 100, func(tx *gorm.DB, batch int) error {
+		for _, texture := range textures {
+			response.Checked++
+			img, err := png.Decode(bytes.NewReader(texture.Data))
+			if err != nil {
+				response.Mismatches = append(response.Mismatches, TextureMismatch{Hash: texture.Hash, Error: err.Error()})
+				continue
+			}
+			computed := model.ComputeTextureId(img)
+			if computed == texture.Hash {
+				continue
+			}
+			// 未开启去重时材质 ID 还与所属用户和材质类型有关
+			matched, err := a.matchScopedTexture(texture.Hash, computed)
+			if err != nil {
+				return err
+			}
+			if !matched {
+				response.Mismatches = append(response.Mismatches, TextureMismatch{Hash: texture.Hash, Computed: computed})
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Mismatches) > 0 {
+		log.Printf("材质校验: 共 %d 个, 其中 %d 个不一致\n", response.Checked, len(response.Mismatches))
+	}
+	return &response, nil
+}
+
+func (a *adminServiceImpl) matchScopedTexture(hash string, computed string) (bool, error) {
+	var userTextures []model.UserTexture
+	if err := a.db.Where("hash = ?", hash).Find(&userTextures).Error; err != nil {
+		return false, err
+	}
+	for _, userTexture := range userTextures {
+		if model.ScopedTextureId(computed, userTexture.UserID, userTexture.TextureType) == hash {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CreateInviteCode 生成一个随机邀请码, expiresAt 为 nil 时永不过期
+func (a *adminServiceImpl) CreateInviteCode(maxUses int, expiresAt *time.Time) (*InviteCodeResponse, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	inviteCode := model.InviteCode{
+		Code:      strings.ToUpper(hex.EncodeToString(buf)),
+		MaxUses:   maxUses,
+		ExpiresAt: expiresAt,
+	}
+	if err := a.db.Create(&inviteCode).Error; err != nil {
+		return nil, err
+	}
+	log.Printf("管理员创建了邀请码 %s, 可用次数: %d\n", inviteCode.Code, maxUses)
+	response := toInviteCodeResponse(inviteCode)
+	return &response, nil
+}
+
+func (a *adminServiceImpl) ListInviteCodes() ([]InviteCodeResponse, error) {
+	var inviteCodes []model.InviteCode
+	if err := a.db.Order("created_at").Find(&inviteCodes).Error; err != nil {
+		return nil, err
+	}
+	response := make([]InviteCodeResponse, 0, len(inviteCodes))
+	for _, inviteCode := range inviteCodes {
+		response = append(response, toInviteCodeResponse(inviteCode))
+	}
+	return response, nil
+}
+
+// RevokeInviteCode 删除邀请码, 已使用该邀请码注册的账号不受影响
+func (a *adminServiceImpl) RevokeInviteCode(code string) error {
+	result := a.db.Where("code = ?", code).Delete(&model.InviteCode{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return util.YggdrasilError{
+			Status:       http.StatusNotFound,
+			ErrorCode:    "Not Found",
+			ErrorMessage: "No such invite code.",
+		}
+	}
+	log.Printf("管理员吊销了邀请码 %s\n", code)
+	return nil
+}
+
+func toInviteCodeResponse(inviteCode model.InviteCode) InviteCodeResponse {
+	return InviteCodeResponse{
+		Code:      inviteCode.Code,
+		MaxUses:   inviteCode.MaxUses,
+		Used:      inviteCode.Used,
+		ExpiresAt: inviteCode.ExpiresAt,
+		CreatedAt: inviteCode.CreatedAt,
+	}
+}
+
+// TextureHistory 查询任意用户最近的材质变更记录, 用于处理不当材质
+func (a *adminServiceImpl) TextureHistory(userId uuid.UUID) ([]TextureHistoryEntry, error) {
+	return queryTextureHistory(a.db, userId)
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"fmt"
+	"time"
+)
+
+// CacheCfg 各内存缓存的最大条目数
+type CacheCfg struct {
+	// TokenCacheSize 令牌缓存
+	TokenCacheSize int `ini:"token_cache_size"`
+	// RotatedTokenCacheSize 已刷新令牌的缓存, 用于检测旧令牌被重复使用
+	RotatedTokenCacheSize int `ini:"rotated_token_cache_size"`
+	// SessionCacheSize 加入服务器会话缓存
+	SessionCacheSize int `ini:"session_cache_size"`
+	// ProfileKeyCacheSize 玩家证书密钥对缓存
+	ProfileKeyCacheSize int `ini:"profile_key_cache_size"`
+	// RateLimitCacheSize 内存限流器缓存
+	RateLimitCacheSize int `ini:"rate_limit_cache_size"`
+	// ProfileCacheSize 角色信息响应缓存
+	ProfileCacheSize int `ini:"profile_cache_size"`
+	// ProfileCacheTtl 角色信息响应的缓存时间, 0 表示不缓存
+	ProfileCacheTtl time.Duration `ini:"profile_cache_ttl"`
+}
+
+func DefaultCacheCfg() CacheCfg {
+	return CacheCfg{
+		TokenCacheSize:        10000000,
+		RotatedTokenCacheSize: 100000,
+		SessionCacheSize:      100000,
+		ProfileKeyCacheSize:   10000,
+		RateLimitCacheSize:    10000,
+		ProfileCacheSize:      10000,
+		ProfileCacheTtl:       30 * time.Second,
+	}
+}
+
+func (c CacheCfg) Validate() error {
+	sizes := map[string]int{
+		"token_cache_size":         c.TokenCacheSize,
+		"rotated_token_cache_size": c.RotatedTokenCacheSize,
+		"session_cache_size":       c.SessionCacheSize,
+		"profile_key_cache_size":   c.ProfileKeyCacheSize,
+		"rate_limit_cache_size":    c.RateLimitCacheSize,
+		"profile_cache_size":       c.ProfileCacheSize,
+	}
+	for name, size := range sizes {
+		if size <= 0 {
+			return fmt.Errorf("%s 必须为正数", name)
+		}
+	}
+	if c.ProfileCacheTtl < 0 {
+		return fmt.Errorf("profile_cache_ttl 不能为负数")
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+	"yggdrasil-go/model"
+	"yggdrasil-go/util"
+)
+
+// MojangCfg 批量查询 Mojang 角色的参数
+type MojangCfg struct {
+	// BulkSize 每个批量请求包含的角色名数量, Mojang 限制最多 10 个
+	BulkSize int `ini:"bulk_size"`
+	// BulkConcurrency 同时发出的批量请求数
+	BulkConcurrency int `ini:"bulk_concurrency"`
+	// BulkTimeout 一次批量查询 (所有分批请求) 的总超时时间
+	BulkTimeout time.Duration `ini:"bulk_timeout"`
+	// LookupTimeout 按角色名查询单个角色的超时时间 (含重试)
+	LookupTimeout time.Duration `ini:"lookup_timeout"`
+}
+
+// MojangMaxBulkSize Mojang 批量查询接口单次请求的角色名上限
+const MojangMaxBulkSize = 10
+
+// MojangClient 访问 Mojang 官方接口, 便于在测试中替换
+type MojangClient interface {
+	UsernameToUUID(username string) (model.ProfileResponse, error)
+	UsernamesToUUIDs(usernames []string) ([]model.ProfileResponse, map[string]error)
+	QueryProfile(profileId uuid.UUID, unsigned bool) (map[string]interface{}, error)
+	Refresh(accessToken string, clientToken *string, requestUser bool, selectedProfile *model.ProfileResponse) (*LoginResponse, error)
+	Validate(accessToken string, clientToken *string) error
+	Invalidate(accessToken string) error
+	ProfileKey(accessToken string) (*ProfileKeyResponse, error)
+}
+
+type mojangClientImpl struct {
+	cfg     MojangCfg
+	bulkUrl string
+}
+
+func NewMojangClient(cfg MojangCfg) MojangClient {
+	return &mojangClientImpl{
+		cfg:     cfg,
+		bulkUrl: "https://api.mojang.com/profiles/minecraft",
+	}
+}
+
+func (m *mojangClientImpl) UsernameToUUID(username string) (model.ProfileResponse, error) {
+	response := model.ProfileResponse{}
+	reqUrl := fmt.Sprintf("https://api.mojang.com/users/profiles/minecraft/%s", url.PathEscape(username))
+	ctx := context.Background()
+	if m.cfg.LookupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.cfg.LookupTimeout)
+		defer cancel()
+	}
+	err := util.GetObjectWithContext(ctx, reqUrl, &response)
+	if err != nil {
+		return response, err
+	} else {
+		return response, nil
+	}
+}
+
+// UsernamesToUUIDs 按 BulkSize 分批查询, 返回所有成功批次的结果, 以及失败批次中每个角色名对应的错误
+func (m *mojangClientImpl) UsernamesToUUIDs(usernames []string) ([]model.ProfileResponse, map[string]error) {
+	var chunks [][]string
+	for len(usernames) > 0 {
+		n := m.cfg.BulkSize
+		if n <= 0 || n > MojangMaxBulkSize {
+			n = MojangMaxBulkSize
+		}
+		if n > len(usernames) {
+			n = len(usernames)
+		}
+		chunks = append(chunks, usernames[:n])
+		usernames = usernames[n:]
+	}
+	ctx := context.Background()
+	if m.cfg.BulkTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.cfg.BulkTimeout)
+		defer cancel()
+	}
+	concurrency := m.cfg.BulkConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	results := make([][]model.ProfileResponse, len(chunks))
+	errs := make([]error, len(chunks))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, chunk []string) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			errs[i] = util.PostObjectWithContext(ctx, m.bulkUrl, chunk, &results[i])
+		}(i, chunk)
+	}
+	wg.Wait()
+	responses := make([]model.ProfileResponse, 0, len(chunks)*MojangMaxBulkSize)
+	var failed map[string]error
+	for i, chunk := range chunks {
+		if errs[i] != nil {
+			log.Println("批量查询 Mojang 角色失败", errs[i])
+			if failed == nil {
+				failed = make(map[string]error)
+			}
+			for _, name := range chunk {
+				failed[name] = errs[i]
+			}
+			continue
+		}
+		responses = append(responses, results[i]...)
+	}
+	return responses, failed
+}
+
+func (m *mojangClientImpl) QueryProfile(profileId uuid.UUID, unsigned bool) (map[string]interface{}, error) {
+	result := map[string]interface{}{}
+	reqUrl := fmt.Sprintf("https://sessionserver.mojang.com/session/minecraft/profile/%s?unsigned=%t", util.UnsignedString(profileId), unsigned)
+	if err := util.GetObject(reqUrl, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (m *mojangClientImpl) Refresh(accessToken string, clientToken *string, requestUser bool, selectedProfile *model.ProfileResponse) (*LoginResponse, error) {
+	data := map[string]interface{}{
+		"accessToken":     accessToken,
+		"clientToken":     clientToken,
+		"requestUser":     requestUser,
+		"selectedProfile": selectedProfile,
+	}
+	loginResponse := LoginResponse{}
+	if err := util.PostObject("https://authserver.mojang.com/refresh", data, &loginResponse); err != nil {
+		return nil, err
+	}
+	return &loginResponse, nil
+}
+
+func (m *mojangClientImpl) Validate(accessToken string, clientToken *string) error {
+	data := map[string]interface{}{
+		"accessToken": accessToken,
+		"clientToken": clientToken,
+	}
+	return util.PostObjectForError("https://authserver.mojang.com/validate", data)
+}
+
+func (m *mojangClientImpl) Invalidate(accessToken string) error {
+	data := map[string]interface{}{
+		"accessToken": accessToken,
+	}
+	return util.PostObjectForError("https://authserver.mojang.com/invalidate", data)
+}
+
+func (m *mojangClientImpl) ProfileKey(accessToken string) (*ProfileKeyResponse, error) {
+	resp := new(ProfileKeyResponse)
+	if err := util.PostForString("https://api.minecraftservices.com/player/certificates", accessToken, []byte(""), resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"yggdrasil-go/model"
+	"yggdrasil-go/util"
+)
+
+// newBulkServer 模拟 Mojang 批量查询接口, 记录每个请求的角色名数量;
+// 以 Found 开头的角色名视为存在, 请求中包含 Broken 开头的角色名时整个批次返回 204
+func newBulkServer(t *testing.T) (*httptest.Server, func() []int) {
+	t.Helper()
+	var mu sync.Mutex
+	var sizes []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var names []string
+		if err := json.NewDecoder(r.Body).Decode(&names); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		sizes = append(sizes, len(names))
+		mu.Unlock()
+		responses := make([]model.ProfileResponse, 0, len(names))
+		for _, name := range names {
+			if strings.HasPrefix(name, "Broken") {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			if strings.HasPrefix(name, "Found") {
+				responses = append(responses, model.ProfileResponse{Name: name, Id: util.UnsignedString(util.OfflineUUID(name))})
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(responses)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]int(nil), sizes...)
+	}
+}
+
+func testNames(prefix string, n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s%02d", prefix, i)
+	}
+	return names
+}
+
+func TestUsernamesToUUIDsChunked(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     MojangCfg
+		names   []string
+		wantMax int
+		wantN   int
+	}{
+		{"default bulk size", MojangCfg{}, testNames("Found", 23), MojangMaxBulkSize, 3},
+		{"bulk size above limit", MojangCfg{BulkSize: 50, BulkConcurrency: 4}, testNames("Found", 23), MojangMaxBulkSize, 3},
+		{"custom bulk size", MojangCfg{BulkSize: 4, BulkConcurrency: 2}, testNames("Found", 11), 4, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, sizes := newBulkServer(t)
+			client := &mojangClientImpl{cfg: tt.cfg, bulkUrl: server.URL}
+			responses, failed := client.UsernamesToUUIDs(tt.names)
+			if len(failed) != 0 {
+				t.Fatalf("failed = %v, want none", failed)
+			}
+			if len(responses) != len(tt.names) {
+				t.Errorf("got %d responses, want %d", len(responses), len(tt.names))
+			}
+			got := sizes()
+			if len(got) != tt.wantN {
+				t.Errorf("got %d batches %v, want %d", len(got), got, tt.wantN)
+			}
+			total := 0
+			for _, size := range got {
+				if size > tt.wantMax {
+					t.Errorf("batch of %d names exceeds %d", size, tt.wantMax)
+				}
+				total += size
+			}
+			if total != len(tt.names) {
+				t.Errorf("batches cover %d names, want %d", total, len(tt.names))
+			}
+		})
+	}
+
+	t.Run("failed batch", func(t *testing.T) {
+		server, _ := newBulkServer(t)
+		client := &mojangClientImpl{cfg: MojangCfg{BulkSize: 5}, bulkUrl: server.URL}
+		names := append(testNames("Found", 10), "Broken")
+		responses, failed := client.UsernamesToUUIDs(names)
+		// 前两个批次成功, 只有包含 Broken 的最后一个批次失败
+		if len(responses) != 10 {
+			t.Errorf("got %d responses, want 10", len(responses))
+		}
+		if len(failed) != 1 || failed["Broken"] == nil {
+			t.Errorf("failed = %v, want only Broken", failed)
+		}
+	})
+}
+
+func TestQueryUUIDsDetailedMojangBatches(t *testing.T) {
+	server, sizes := newBulkServer(t)
+	db := newTestDB(t)
+	u := newTestUserService(t, db, &mojangClientImpl{cfg: MojangCfg{BulkSize: 3}, bulkUrl: server.URL})
+	createTestUser(t, u, "local@example.com", "Local")
+
+	names := append([]string{"Local"}, testNames("Found", 8)...)
+	names = append(names, testNames("Missing", 4)...)
+	results, err := u.QueryUUIDsDetailed(names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 最多查询前 10 个角色名, 本地已存在的角色不会转发到 Mojang
+	if len(results) != 10 {
+		t.Fatalf("got %d results, want 10", len(results))
+	}
+	for i, result := range results {
+		want := LookupFound
+		if i == 9 {
+			want = LookupNotFound
+		}
+		if result.Name != names[i] || result.Status != want {
+			t.Errorf("results[%d] = %+v, want %s %s", i, result, names[i], want)
+		}
+	}
+	got := sizes()
+	total := 0
+	for _, size := range got {
+		if size > 3 {
+			t.Errorf("batch of %d names exceeds bulk size 3", size)
+		}
+		total += size
+	}
+	if total != 9 {
+		t.Errorf("batches %v cover %d names, want 9", got, total)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+	"yggdrasil-go/util"
+)
+
+// PasswordPolicy 密码复杂度规则
+type PasswordPolicy struct {
+	MinLength        int  `ini:"min_length"`
+	RequireUpper     bool `ini:"require_upper"`
+	RequireLower     bool `ini:"require_lower"`
+	RequireDigit     bool `ini:"require_digit"`
+	RequireSymbol    bool `ini:"require_symbol"`
+	DisallowUsername bool `ini:"disallow_username"`
+}
+
+// Check 校验密码, 返回第一条不满足的规则对应的 IllegalArgumentError
+func (p *PasswordPolicy) Check(username string, password string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return util.NewIllegalArgumentError(fmt.Sprintf("password must be at least %d characters", p.MinLength))
+	}
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			hasSymbol = true
+		}
+	}
+	if p.RequireUpper && !hasUpper {
+		return util.NewIllegalArgumentError("password must contain an uppercase letter")
+	}
+	if p.RequireLower && !hasLower {
+		return util.NewIllegalArgumentError("password must contain a lowercase letter")
+	}
+	if p.RequireDigit && !hasDigit {
+		return util.NewIllegalArgumentError("password must contain a digit")
+	}
+	if p.RequireSymbol && !hasSymbol {
+		return util.NewIllegalArgumentError("password must contain a symbol")
+	}
+	if p.DisallowUsername {
+		lowerPassword := strings.ToLower(password)
+		lowerUsername := strings.ToLower(username)
+		localPart := strings.SplitN(lowerUsername, "@", 2)[0]
+		if lowerPassword == lowerUsername || lowerPassword == localPart {
+			return util.NewIllegalArgumentError("password must not be the same as the email")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import "testing"
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	strict := PasswordPolicy{
+		MinLength:        8,
+		RequireUpper:     true,
+		RequireLower:     true,
+		RequireDigit:     true,
+		RequireSymbol:    true,
+		DisallowUsername: true,
+	}
+	tests := []struct {
+		name     string
+		policy   PasswordPolicy
+		username string
+		password string
+		wantErr  string
+	}{
+		{name: "empty policy", policy: PasswordPolicy{}, username: "a@example.com", password: "x"},
+		{name: "valid", policy: strict, username: "alice@example.com", password: "Passw0rd!"},
+		{name: "too short", policy: strict, username: "alice@example.com", password: "Pa0!", wantErr: "password must be at least 8 characters"},
+		{name: "min length counts runes", policy: PasswordPolicy{MinLength: 4}, username: "alice@example.com", password: "密码密码"},
+		{name: "missing upper", policy: strict, username: "alice@example.com", password: "passw0rd!", wantErr: "password must contain an uppercase letter"},
+		{name: "missing lower", policy: strict, username: "alice@example.com", password: "PASSW0RD!", wantErr: "password must contain a lowercase letter"},
+		{name: "missing digit", policy: strict, username: "alice@example.com", password: "Password!", wantErr: "password must contain a digit"},
+		{name: "missing symbol", policy: strict, username: "alice@example.com", password: "Passw0rdX", wantErr: "password must contain a symbol"},
+		{name: "equals email", policy: PasswordPolicy{DisallowUsername: true}, username: "Alice@example.com", password: "alice@EXAMPLE.com", wantErr: "password must not be the same as the email"},
+		{name: "equals local part", policy: PasswordPolicy{DisallowUsername: true}, username: "alice@example.com", password: "ALICE", wantErr: "password must not be the same as the email"},
+		{name: "username allowed when not disallowed", policy: PasswordPolicy{}, username: "alice@example.com", password: "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Check(tt.username, tt.password)
+			if got := errorMessage(err); got != tt.wantErr {
+				t.Fatalf("Check(%q, %q) error = %q, want %q", tt.username, tt.password, got, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import "yggdrasil-go/model"
+
+// PrivilegesCfg 返回给客户端的玩家权限 (/player/attributes)
+type PrivilegesCfg struct {
+	OnlineChat        bool `ini:"online_chat"`
+	MultiplayerServer bool `ini:"multiplayer_server"`
+	MultiplayerRealms bool `ini:"multiplayer_realms"`
+	Telemetry         bool `ini:"telemetry"`
+	ProfanityFilter   bool `ini:"profanity_filter"`
+}
+
+type Privilege struct {
+	Enabled bool `json:"enabled"`
+}
+
+type PlayerAttributesResponse struct {
+	Privileges struct {
+		OnlineChat        Privilege `json:"onlineChat"`
+		MultiplayerServer Privilege `json:"multiplayerServer"`
+		MultiplayerRealms Privilege `json:"multiplayerRealms"`
+		Telemetry         Privilege `json:"telemetry"`
+	} `json:"privileges"`
+	ProfanityFilterPreferences struct {
+		ProfanityFilterOn bool `json:"profanityFilterOn"`
+	} `json:"profanityFilterPreferences"`
+	BanStatus struct {
+		BannedScopes map[string]interface{} `json:"bannedScopes"`
+	} `json:"banStatus"`
+}
+
+// withOverrides 合并用户单独设置的限制
+func (p PrivilegesCfg) withOverrides(user *model.User) PrivilegesCfg {
+	if user.ChatDisabled {
+		p.OnlineChat = false
+	}
+	if user.MultiplayerDisabled {
+		p.MultiplayerServer = false
+	}
+	if user.RealmsDisabled {
+		p.MultiplayerRealms = false
+	}
+	return p
+}
+
+type BlockListResponse struct {
+	BlockedProfiles []string `json:"blockedProfiles"`
+}
+
+func (p PrivilegesCfg) toResponse() PlayerAttributesResponse {
+	response := PlayerAttributesResponse{}
+	response.Privileges.OnlineChat.Enabled = p.OnlineChat
+	response.Privileges.MultiplayerServer.Enabled = p.MultiplayerServer
+	response.Privileges.MultiplayerRealms.Enabled = p.MultiplayerRealms
+	response.Privileges.Telemetry.Enabled = p.Telemetry
+	response.ProfanityFilterPreferences.ProfanityFilterOn = p.ProfanityFilter
+	response.BanStatus.BannedScopes = map[string]interface{}{}
+	return response
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	lru "github.com/hashicorp/golang-lru"
+	"sync"
+	"time"
+)
+
+// ProfileCache 缓存角色信息接口 (QueryProfile) 的响应, 避免重复查询数据库和计算签名;
+// 角色名或材质变化时需调用 Invalidate
+type ProfileCache interface {
+	Get(profileId uuid.UUID, unsigned bool, textureBaseUrl string) (map[string]interface{}, bool)
+	Add(profileId uuid.UUID, unsigned bool, textureBaseUrl string, response map[string]interface{})
+	Invalidate(profileId uuid.UUID)
+}
+
+type profileCacheEntry struct {
+	response  map[string]interface{}
+	expiresAt time.Time
+}
+
+type profileCacheImpl struct {
+	ttl   time.Duration
+	lock  sync.Mutex
+	cache *lru.Cache
+}
+
+// NewProfileCache 创建角色信息缓存, ttl 为 0 时不缓存
+func NewProfileCache(cacheCfg CacheCfg) ProfileCache {
+	cache, _ := lru.New(cacheCfg.ProfileCacheSize)
+	return &profileCacheImpl{
+		ttl:   cacheCfg.ProfileCacheTtl,
+		cache: cache,
+	}
+}
+
+func profileCacheVariant(unsigned bool, textureBaseUrl string) string {
+	return fmt.Sprintf("%t|%s", unsigned, textureBaseUrl)
+}
+
+func (p *profileCacheImpl) Get(profileId uuid.UUID, unsigned bool, textureBaseUrl string) (map[string]interface{}, bool) {
+	if p.ttl <= 0 {
+		return nil, false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	value, ok := p.cache.Get(profileId)
+	if !ok {
+		return nil, false
+	}
+	variants := value.(map[string]profileCacheEntry)
+	variant := profileCacheVariant(unsigned, textureBaseUrl)
+	entry, ok := variants[variant]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(variants, variant)
+		return nil, false
+	}
+	return entry.response, true
+}
+
+func (p *profileCacheImpl) Add(profileId uuid.UUID, unsigned bool, textureBaseUrl string, response map[string]interface{}) {
+	if p.ttl <= 0 {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var variants map[string]profileCacheEntry
+	if value, ok := p.cache.Get(profileId); ok {
+		variants = value.(map[string]profileCacheEntry)
+	} else {
+		variants = make(map[string]profileCacheEntry)
+		p.cache.Add(profileId, variants)
+	}
+	variants[profileCacheVariant(unsigned, textureBaseUrl)] = profileCacheEntry{
+		response:  response,
+		expiresAt: time.Now().Add(p.ttl),
+	}
+}
+
+func (p *profileCacheImpl) Invalidate(profileId uuid.UUID) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.cache.Remove(profileId)
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/google/uuid"
+	"image"
+	"image/png"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProfileCacheHitAndVariants(t *testing.T) {
+	cache := NewProfileCache(CacheCfg{ProfileCacheSize: 10, ProfileCacheTtl: time.Minute})
+	profileId := uuid.New()
+	signed := map[string]interface{}{"variant": "signed"}
+	unsigned := map[string]interface{}{"variant": "unsigned"}
+	otherHost := map[string]interface{}{"variant": "other host"}
+
+	if _, ok := cache.Get(profileId, false, "https://a.example.com/"); ok {
+		t.Fatal("unexpected hit on empty cache")
+	}
+	cache.Add(profileId, false, "https://a.example.com/", signed)
+	cache.Add(profileId, true, "https://a.example.com/", unsigned)
+	cache.Add(profileId, false, "https://b.example.com/", otherHost)
+
+	tests := []struct {
+		unsigned bool
+		baseUrl  string
+		want     map[string]interface{}
+	}{
+		{false, "https://a.example.com/", signed},
+		{true, "https://a.example.com/", unsigned},
+		{false, "https://b.example.com/", otherHost},
+		{true, "https://b.example.com/", nil},
+	}
+	for _, tt := range tests {
+		got, ok := cache.Get(profileId, tt.unsigned, tt.baseUrl)
+		if ok != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Get(%t, %s) = %v, %t, want %v", tt.unsigned, tt.baseUrl, got, ok, tt.want)
+		}
+	}
+	if _, ok := cache.Get(uuid.New(), false, "https://a.example.com/"); ok {
+		t.Error("unexpected hit for another profile")
+	}
+
+	// Invalidate 清除该角色的所有变体
+	cache.Invalidate(profileId)
+	for _, tt := range tests {
+		if _, ok := cache.Get(profileId, tt.unsigned, tt.baseUrl); ok {
+			t.Errorf("Get(%t, %s) hit after Invalidate", tt.unsigned, tt.baseUrl)
+		}
+	}
+}
+
+func TestProfileCacheTtl(t *testing.T) {
+	profileId := uuid.New()
+	response := map[string]interface{}{"id": profileId.String()}
+
+	cache := NewProfileCache(CacheCfg{ProfileCacheSize: 10, ProfileCacheTtl: 20 * time.Millisecond})
+	cache.Add(profileId, false, "", response)
+	if _, ok := cache.Get(profileId, false, ""); !ok {
+		t.Fatal("expected hit before expiry")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := cache.Get(profileId, false, ""); ok {
+		t.Error("expected miss after ttl")
+	}
+
+	disabled := NewProfileCache(CacheCfg{ProfileCacheSize: 10, ProfileCacheTtl: 0})
+	disabled.Add(profileId, false, "", response)
+	if _, ok := disabled.Get(profileId, false, ""); ok {
+		t.Error("ttl 0 should disable caching")
+	}
+}
+
+func TestProfileCacheInvalidatedOnSkinChange(t *testing.T) {
+	u := newTestUserService(t, newTestDB(t), &fakeMojangClient{})
+	user, token := createTestUser(t, u, "tester@example.com", "Tester")
+	textureService := NewTextureService(u.tokenService, u.profileCache, u.db, TextureCfg{
+		UploadableTextures: []string{"skin"},
+		AllowedImageTypes:  []string{"png"},
+		MaxSkinSize:        64,
+	})
+	const baseUrl = "https://skin.example.com/"
+
+	first, err := u.QueryProfile(user.ID, true, baseUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached, ok := u.profileCache.Get(user.ID, true, baseUrl); !ok || !reflect.DeepEqual(cached, first) {
+		t.Fatal("QueryProfile did not populate the cache")
+	}
+
+	skin := bytes.Buffer{}
+	if err := png.Encode(&skin, image.NewNRGBA(image.Rect(0, 0, 64, 64))); err != nil {
+		t.Fatal(err)
+	}
+	if err := textureService.UploadTexture(token.AccessToken, user.ID, &skin, "skin", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := u.profileCache.Get(user.ID, true, baseUrl); ok {
+		t.Fatal("cache not invalidated after skin upload")
+	}
+	second, err := u.QueryProfile(user.ID, true, baseUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasSkin(t, first) || !hasSkin(t, second) {
+		t.Error("QueryProfile returned a stale response after skin upload")
+	}
+}
+
+// hasSkin 解码角色信息中的 textures 属性, 判断是否包含皮肤
+func hasSkin(t *testing.T, response map[string]interface{}) bool {
+	t.Helper()
+	for _, property := range response["properties"].([]map[string]string) {
+		if property["name"] != "textures" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(property["value"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var value struct {
+			Textures struct {
+				SKIN *struct{ Url string }
+			}
+		}
+		if err := json.Unmarshal(decoded, &value); err != nil {
+			t.Fatal(err)
+		}
+		return value.Textures.SKIN != nil
+	}
+	t.Fatal("textures property missing")
+	return false
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"errors"
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/time/rate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
+	"time"
+	"yggdrasil-go/model"
+)
+
+type RateLimitCfg struct {
+	// Backend 限流器存储方式, memory 或 database
+	Backend string `ini:"backend"`
+}
+
+// RateLimiter 按 key 限制操作频率
+type RateLimiter interface {
+	Allow(key string) bool
+}
+
+func NewRateLimiter(cfg RateLimitCfg, cacheCfg CacheCfg, db *gorm.DB, limit rate.Limit, burst int) RateLimiter {
+	switch cfg.Backend {
+	case "database":
+		return &dbRateLimiter{db: db, limit: limit, burst: burst}
+	default:
+		cache, _ := lru.New(cacheCfg.RateLimitCacheSize)
+		return &memoryRateLimiter{cache: cache, limit: limit, burst: burst}
+	}
+}
+
+type memoryRateLimiter struct {
+	cache *lru.Cache
+	limit rate.Limit
+	burst int
+}
+
+func (m *memoryRateLimiter) Allow(key string) bool {
+	if value, ok := m.cache.Get(key); ok {
+		if limiter, ok := value.(*rate.Limiter); ok {
+			return limiter.Allow()
+		} else {
+			m.cache.Remove(key)
+		}
+	}
+	limiter := rate.NewLimiter(m.limit, m.burst)
+	m.cache.Add(key, limiter)
+	return limiter.Allow()
+}
+
+// dbRateLimiter 将令牌桶保存在数据库中, 供多实例部署共享
+type dbRateLimiter struct {
+	db    *gorm.DB
+	limit rate.Limit
+	burst int
+}
+
+func (d *dbRateLimiter) Allow(key string) bool {
+	allowed := false
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		record := model.RateLimit{}
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&record, "id = ?", key).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			allowed = true
+			record = model.RateLimit{ID: key, Tokens: float64(d.burst) - 1, UpdatedAt: now}
+			return tx.Create(&record).Error
+		} else if err != nil {
+			return err
+		}
+		tokens := record.Tokens + now.Sub(record.UpdatedAt).Seconds()*float64(d.limit)
+		if tokens > float64(d.burst) {
+			tokens = float64(d.burst)
+		}
+		if tokens >= 1 {
+			tokens--
+			allowed = true
+		}
+		return tx.Model(&record).Updates(map[string]interface{}{"tokens": tokens, "updated_at": now}).Error
+	})
+	if err != nil {
+		log.Println("无法更新限流状态", err)
+		return true
+	}
+	return allowed
+}
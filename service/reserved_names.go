@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ReservedNames 禁止注册或更改为的角色名, 不区分大小写
+// 普通条目精确匹配, 含 * 或 ? 的条目按通配符匹配, 以 re: 开头的条目按正则表达式匹配整个角色名
+type ReservedNames struct {
+	exact    map[string]bool
+	globs    []string
+	patterns []*regexp.Regexp
+}
+
+// LoadReservedNames 解析配置中的条目, 以及 file 中每行一个的条目 (# 开头的行为注释)
+func LoadReservedNames(entries []string, file string) (ReservedNames, error) {
+	names := ReservedNames{exact: make(map[string]bool)}
+	if len(file) > 0 {
+		f, err := os.Open(file)
+		if err != nil {
+			return names, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if !strings.HasPrefix(line, "#") {
+				entries = append(entries, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return names, err
+		}
+	}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case len(entry) == 0:
+			continue
+		case strings.HasPrefix(entry, "re:"):
+			pattern, err := regexp.Compile("(?i)^(?:" + strings.TrimPrefix(entry, "re:") + ")$")
+			if err != nil {
+				return names, fmt.Errorf("无效的正则表达式 %s: %w", entry, err)
+			}
+			names.patterns = append(names.patterns, pattern)
+		case strings.ContainsAny(entry, "*?["):
+			if _, err := path.Match(entry, ""); err != nil {
+				return names, fmt.Errorf("无效的通配符 %s: %w", entry, err)
+			}
+			names.globs = append(names.globs, strings.ToLower(entry))
+		default:
+			names.exact[strings.ToLower(entry)] = true
+		}
+	}
+	return names, nil
+}
+
+func (r *ReservedNames) Contains(name string) bool {
+	lowerName := strings.ToLower(name)
+	if r.exact[lowerName] {
+		return true
+	}
+	for _, glob := range r.globs {
+		if matched, _ := path.Match(glob, lowerName); matched {
+			return true
+		}
+	}
+	for _, pattern := range r.patterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
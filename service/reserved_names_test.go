@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReservedNamesContains(t *testing.T) {
+	names, err := LoadReservedNames([]string{"Admin", " root ", "", "mod_*", "staff?", "re:[0-9]+", "re:Owner(_\\d+)?"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"Admin", true},
+		{"ADMIN", true},
+		{"admin", true},
+		{"root", true},
+		{"Administrator", false},
+		{"mod_alice", true},
+		{"MOD_Bob", true},
+		{"mod", false},
+		{"staff1", true},
+		{"staff12", false},
+		{"12345", true},
+		{"a12345", false},
+		{"owner", true},
+		{"OWNER_42", true},
+		{"owner_x", false},
+		{"Steve", false},
+	}
+	for _, tt := range tests {
+		if got := names.Contains(tt.name); got != tt.want {
+			t.Errorf("Contains(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReservedNamesFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "reserved.txt")
+	if err := os.WriteFile(file, []byte("# 注释\nNotch\n\nre:jeb_?\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	names, err := LoadReservedNames([]string{"Admin"}, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"admin", "notch", "Jeb_", "jeb"} {
+		if !names.Contains(name) {
+			t.Errorf("Contains(%q) = false, want true", name)
+		}
+	}
+	if names.Contains("# 注释") {
+		t.Error("comment line loaded as reserved name")
+	}
+	if _, err := LoadReservedNames(nil, filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestReservedNamesInvalidEntry(t *testing.T) {
+	tests := []struct {
+		entry   string
+		wantErr string
+	}{
+		{"re:(unclosed", "无效的正则表达式 re:(unclosed"},
+		{"re:a[", "无效的正则表达式 re:a["},
+		{"bad[", "无效的通配符 bad["},
+	}
+	for _, tt := range tests {
+		_, err := LoadReservedNames([]string{"Admin", tt.entry}, "")
+		if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+			t.Errorf("LoadReservedNames(%q) error = %v, want prefix %q", tt.entry, err, tt.wantErr)
+		}
+	}
+}
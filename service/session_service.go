@@ -20,8 +20,10 @@ package service
 import (
 	"fmt"
 	lru "github.com/hashicorp/golang-lru"
+	"log"
 	"net/http"
 	"net/url"
+	"sync/atomic"
 	"yggdrasil-go/model"
 	"yggdrasil-go/util"
 )
@@ -31,20 +33,40 @@ type SessionService interface {
 	HasJoinedServer(serverId string, username string, ip string, textureBaseUrl string) (map[string]interface{}, error)
 }
 
+type SessionCfg struct {
+	// SignHasJoined hasJoined 响应是否对角色属性签名
+	SignHasJoined bool `ini:"sign_has_joined"`
+}
+
 type sessionStore struct {
+	cfg          SessionCfg
 	sessionCache *lru.Cache
 	tokenService TokenService
+	textureCfg   TextureCfg
+	evictions    int64
 }
 
-func NewSessionService(service TokenService) SessionService {
-	cache, _ := lru.New(100000)
+func NewSessionService(service TokenService, cfg SessionCfg, textureCfg TextureCfg, cacheCfg CacheCfg) SessionService {
 	store := sessionStore{
-		sessionCache: cache,
+		cfg:          cfg,
 		tokenService: service,
+		textureCfg:   textureCfg,
 	}
+	store.sessionCache, _ = lru.NewWithEvict(cacheCfg.SessionCacheSize, store.onEvicted)
+	util.RegisterCounter("yggdrasil_session_cache_evictions_total", "Number of unexpired join sessions evicted because the session cache was full.", func() float64 {
+		return float64(atomic.LoadInt64(&store.evictions))
+	})
 	return &store
 }
 
+// onEvicted 只有过期的会话会被主动移除, 未过期的会话被淘汰说明缓存已满, 玩家将无法进入服务器
+func (s *sessionStore) onEvicted(_ interface{}, value interface{}) {
+	if session, ok := value.(*model.AuthenticationSession); ok && !session.HasExpired() {
+		atomic.AddInt64(&s.evictions, 1)
+		log.Printf("会话缓存已满, 已淘汰角色 %s 的会话\n", session.Token.SelectedProfile.Name)
+	}
+}
+
 func (s *sessionStore) JoinServer(accessToken string, serverId string, selectedProfile string, ip string) error {
 	token, ok := s.tokenService.GetToken(accessToken)
 	if ok {
@@ -73,7 +95,7 @@ func (s *sessionStore) HasJoinedServer(serverId string, username string, ip stri
 		if session, ok := value.(*model.AuthenticationSession); ok {
 			if !(session.HasExpired() && s.sessionCache.Remove(serverId)) &&
 				(ip == "" || ip == session.Ip) && (session.Token.SelectedProfile.Name == username) {
-				return session.Token.SelectedProfile.ToCompleteResponse(true, textureBaseUrl)
+				return session.Token.SelectedProfile.ToCompleteResponse(s.cfg.SignHasJoined, textureBaseUrl, s.textureCfg.UploadableTextures, s.textureCfg.HdSkins)
 			}
 		}
 	} else {
@@ -86,7 +108,7 @@ func (s *sessionStore) HasJoinedServer(serverId string, username string, ip stri
 		if err != nil {
 			return nil, err
 		} else {
-			return m, nil
+			return model.SanitizeProfileResponse(m), nil
 		}
 	}
 	return nil, util.YggdrasilError{Status: http.StatusNoContent}
@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"github.com/google/uuid"
+	"testing"
+	"yggdrasil-go/model"
+	"yggdrasil-go/util"
+)
+
+func TestHasJoinedServerSignature(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := util.PrivateKey
+	util.PrivateKey = privateKey
+	t.Cleanup(func() { util.PrivateKey = oldKey })
+
+	for _, sign := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sign=%v", sign), func(t *testing.T) {
+			tokenService := NewTokenService(TokenCfg{
+				ValidDuration:   model.DefaultTokenValidDuration,
+				RefreshDuration: model.DefaultTokenRefreshDuration,
+			}, DefaultCacheCfg())
+			sessionService := NewSessionService(tokenService, SessionCfg{SignHasJoined: sign}, TextureCfg{}, DefaultCacheCfg())
+			user := &model.User{ID: uuid.New(), ProfileName: "Tester"}
+			token, err := tokenService.AcquireToken(user, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sessionService.JoinServer(token.AccessToken, "server-id", util.UnsignedString(user.ID), "10.0.0.1"); err != nil {
+				t.Fatal(err)
+			}
+
+			response, err := sessionService.HasJoinedServer("server-id", "Tester", "10.0.0.1", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			properties := response["properties"].([]map[string]string)
+			if len(properties) == 0 {
+				t.Fatal("no properties in hasJoined response")
+			}
+			for _, property := range properties {
+				signature, ok := property["signature"]
+				if ok != sign {
+					t.Fatalf("property %s: signature present = %v, want %v", property["name"], ok, sign)
+				}
+				if !sign {
+					continue
+				}
+				decoded, err := base64.StdEncoding.DecodeString(signature)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sum := sha1.Sum([]byte(property["value"]))
+				if err := rsa.VerifyPKCS1v15(&privateKey.PublicKey, crypto.SHA1, sum[:], decoded); err != nil {
+					t.Errorf("property %s: invalid signature: %v", property["name"], err)
+				}
+			}
+
+			// IP 不一致时视为未加入
+			if _, err := sessionService.HasJoinedServer("server-id", "Tester", "10.0.0.2", ""); err == nil {
+				t.Error("hasJoined with mismatched ip should fail")
+			}
+		})
+	}
+}
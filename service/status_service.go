@@ -0,0 +1,73 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"gorm.io/gorm"
+	"net/http"
+	"sync"
+	"time"
+	"yggdrasil-go/model"
+	"yggdrasil-go/util"
+)
+
+type StatusService interface {
+	PlayerCount(ip string) (int64, error)
+}
+
+type statusServiceImpl struct {
+	db        *gorm.DB
+	limiter   RateLimiter
+	mu        sync.Mutex
+	count     int64
+	countedAt time.Time
+}
+
+// statusCacheTime 注册玩家数的缓存时间
+const statusCacheTime = 30 * time.Second
+
+func NewStatusService(db *gorm.DB, rateLimitCfg RateLimitCfg, cacheCfg CacheCfg) StatusService {
+	statusService := statusServiceImpl{
+		db:      db,
+		limiter: NewRateLimiter(rateLimitCfg, cacheCfg, db, 1, 10),
+	}
+	return &statusService
+}
+
+// PlayerCount 返回已注册(已通过审核)的玩家数, 结果会缓存一段时间
+func (s *statusServiceImpl) PlayerCount(ip string) (int64, error) {
+	if !s.limiter.Allow("status:" + ip) {
+		return 0, util.YggdrasilError{
+			Status:       http.StatusTooManyRequests,
+			ErrorCode:    "ForbiddenOperationException",
+			ErrorMessage: "Too many requests",
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.countedAt) < statusCacheTime {
+		return s.count, nil
+	}
+	var count int64
+	if err := s.db.Model(&model.User{}).Where("pending = ?", false).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	s.count = count
+	s.countedAt = time.Now()
+	return count, nil
+}
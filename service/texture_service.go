@@ -19,15 +19,20 @@ package service
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"image"
 	_ "image/jpeg"
 	"image/png"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 	"yggdrasil-go/model"
 	"yggdrasil-go/util"
 )
@@ -37,22 +42,109 @@ type TextureService interface {
 	SetTexture(accessToken string, profileId uuid.UUID, skinUrl string, textureType string, model *model.ModelType) error
 	UploadTexture(accessToken string, profileId uuid.UUID, skinReader io.Reader, textureType string, model *model.ModelType) error
 	DeleteTexture(accessToken string, profileId uuid.UUID, textureType string) error
+	TextureHistory(accessToken string, profileId uuid.UUID) ([]TextureHistoryEntry, error)
+}
+
+type TextureCfg struct {
+	// UploadableTextures 允许上传的材质类型, 可选 skin, cape, elytra
+	UploadableTextures []string `ini:"uploadable_textures"`
+	// Deduplicate 相同图像的材质只保存一份并引用计数, 关闭时每个用户的每种材质单独保存
+	Deduplicate bool `ini:"deduplicate"`
+	// MaxSkinSize 皮肤最大宽度 (像素), 不超过 MaxTextureDimension
+	MaxSkinSize int `ini:"max_skin_size"`
+	// MaxCapeSize 披风和鞘翅最大宽度 (像素), 不超过 MaxTextureDimension
+	MaxCapeSize int `ini:"max_cape_size"`
+	// AllowedImageTypes 允许上传的图像格式, 可选 png, jpeg, 按文件头识别
+	AllowedImageTypes []string `ini:"allowed_image_types"`
+	// MaxSkinBytes 皮肤文件最大字节数, 不超过 MaxTextureBytes
+	MaxSkinBytes int64 `ini:"max_skin_bytes"`
+	// MaxCapeBytes 披风和鞘翅文件最大字节数, 不超过 MaxTextureBytes
+	MaxCapeBytes int64 `ini:"max_cape_bytes"`
+	// HdSkins 允许上传与普通皮肤并存的高清皮肤 (skin_hd), 并在角色信息中提供其地址和分辨率
+	HdSkins bool `ini:"hd_skins"`
+	// MaxHdSkinSize 高清皮肤最大边长 (像素), 不超过 MaxTextureDimension
+	MaxHdSkinSize int `ini:"max_hd_skin_size"`
+	// ScanUrl 保存材质前将 PNG 图像 POST 到该地址进行内容审查, 为空时不审查
+	ScanUrl string `ini:"scan_url"`
+	// ScanTimeout 内容审查请求的超时时间
+	ScanTimeout time.Duration `ini:"scan_timeout"`
+	// ScanFailOpen 审查服务不可用时仍允许保存材质, 为 false 时拒绝上传
+	ScanFailOpen bool `ini:"scan_fail_open"`
+}
+
+// textureOpDuration 材质操作耗时, operation 为 get (读取, 不区分材质类型), decode (读取并解码上传的图像),
+// encode (编码为 PNG), hash (计算材质 ID) 或 save (保存材质的总耗时)
+var textureOpDuration = util.RegisterHistogram("yggdrasil_texture_operation_duration_seconds",
+	"Time spent on texture operations, by texture type and operation.", util.LatencyBuckets, "type", "operation")
+
+// MaxTextureHistory 查询材质变更记录时最多返回的条数
+const MaxTextureHistory = 100
+
+type TextureHistoryEntry struct {
+	Type      string    `json:"type"`
+	OldHash   string    `json:"oldHash,omitempty"`
+	NewHash   string    `json:"newHash,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ScanResult 内容审查服务的响应
+type ScanResult struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// MaxTextureBytes 材质文件大小的硬上限
+const MaxTextureBytes = 1 << 20
+
+// MaxTextureDimension 材质单边像素数的硬上限
+const MaxTextureDimension = 1024
+
+// IsUploadable 检查材质类型 (小写) 是否允许上传
+func (c *TextureCfg) IsUploadable(textureType string) bool {
+	if textureType == "skin_hd" {
+		return c.HdSkins
+	}
+	for _, t := range c.UploadableTextures {
+		if t == textureType {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxBytes 返回材质类型 (不区分大小写) 允许的最大文件字节数
+func (c *TextureCfg) MaxBytes(textureType string) int64 {
+	maxBytes := c.MaxSkinBytes
+	if textureType = strings.ToUpper(textureType); textureType == "CAPE" || textureType == "ELYTRA" {
+		maxBytes = c.MaxCapeBytes
+	} else if textureType == "SKIN_HD" {
+		maxBytes = MaxTextureBytes
+	}
+	if maxBytes <= 0 || maxBytes > MaxTextureBytes {
+		maxBytes = MaxTextureBytes
+	}
+	return maxBytes
 }
 
 type textureServiceImpl struct {
+	cfg          TextureCfg
 	tokenService TokenService
+	profileCache ProfileCache
 	db           *gorm.DB
 }
 
-func NewTextureService(tokenService TokenService, db *gorm.DB) TextureService {
+func NewTextureService(tokenService TokenService, profileCache ProfileCache, db *gorm.DB, cfg TextureCfg) TextureService {
 	textureService := textureServiceImpl{
+		cfg:          cfg,
 		tokenService: tokenService,
+		profileCache: profileCache,
 		db:           db,
 	}
 	return &textureService
 }
 
 func (t *textureServiceImpl) GetTexture(hash string) ([]byte, error) {
+	defer textureOpDuration.ObserveSince(time.Now(), "", "get")
 	texture := model.Texture{}
 	if err := t.db.First(&texture, "hash = ?", hash).Error; err == nil {
 		return texture.Data, nil
@@ -82,21 +174,15 @@ func (t *textureServiceImpl) SetTexture(accessToken string, profileId uuid.UUID,
 	if err != nil {
 		return util.NewIllegalArgumentError("Invalid skin url: " + err.Error())
 	}
-	response, err := http.Get(skinDownloadUrl.String())
+	response, err := util.HttpClient().Get(skinDownloadUrl.String())
 	if err != nil {
 		return err
 	}
 	defer response.Body.Close()
-	if response.ContentLength > 1048576 {
-		return util.NewIllegalArgumentError("File too large(more than 1MiB)")
-	}
-	reader := io.LimitReader(response.Body, 1048576)
-	var header bytes.Buffer
-	conf, _, err := image.DecodeConfig(io.TeeReader(reader, &header))
-	if err != nil || conf.Width > 1024 || conf.Height > 1024 {
-		return util.NewIllegalArgumentError("Image too large(max 1024 pixels each dimension)")
+	if response.ContentLength > t.cfg.MaxBytes(textureType) {
+		return fileTooLargeError(t.cfg.MaxBytes(textureType))
 	}
-	im, _, err := image.Decode(io.MultiReader(&header, reader))
+	im, err := t.decodeTexture(response.Body, textureType)
 	if err != nil {
 		return err
 	}
@@ -105,7 +191,8 @@ func (t *textureServiceImpl) SetTexture(accessToken string, profileId uuid.UUID,
 		return err
 	} else {
 		profile, _ := user.Profile()
-		token.SelectedProfile = *profile
+		t.tokenService.UpdateProfile(profileId, profile)
+		t.profileCache.Invalidate(profileId)
 		return nil
 	}
 }
@@ -122,13 +209,7 @@ func (t *textureServiceImpl) UploadTexture(accessToken string, profileId uuid.UU
 	if err := t.db.First(&user, profileId).Error; err != nil {
 		return util.NewForbiddenOperationError(util.MessageProfileNotFound)
 	}
-	reader := io.LimitReader(skinReader, 1048576)
-	var header bytes.Buffer
-	conf, _, err := image.DecodeConfig(io.TeeReader(reader, &header))
-	if err != nil || conf.Width > 1024 || conf.Height > 1024 {
-		return util.NewIllegalArgumentError("Image too large(max 1024 pixels each dimension)")
-	}
-	im, _, err := image.Decode(io.MultiReader(&header, reader))
+	im, err := t.decodeTexture(skinReader, textureType)
 	if err != nil {
 		return err
 	}
@@ -137,7 +218,8 @@ func (t *textureServiceImpl) UploadTexture(accessToken string, profileId uuid.UU
 		return err
 	} else {
 		profile, _ := user.Profile()
-		token.SelectedProfile = *profile
+		t.tokenService.UpdateProfile(profileId, profile)
+		t.profileCache.Invalidate(profileId)
 		return nil
 	}
 }
@@ -154,29 +236,21 @@ func (t *textureServiceImpl) DeleteTexture(accessToken string, profileId uuid.UU
 	if err := t.db.First(&user, profileId).Error; err != nil {
 		return util.NewForbiddenOperationError(util.MessageProfileNotFound)
 	}
-	textureType = strings.ToUpper(textureType)
-	if textureType != "SKIN" && textureType != "CAPE" {
-		textureType = "SKIN"
+	textureType = normalizeTextureType(textureType)
+	profile, err := user.Profile()
+	if err != nil {
+		return err
 	}
-	var profile *model.Profile
-	hash, ok := token.SelectedProfile.Textures[textureType]
+	hash, ok := profile.Textures[textureType]
 	if ok {
-		delete(token.SelectedProfile.Textures, textureType)
-		profile = &token.SelectedProfile
-	} else {
-		p, err := user.Profile()
-		if err != nil {
-			return err
-		}
-		hash, ok = p.Textures[textureType]
-		if ok {
-			delete(p.Textures, textureType)
-		} else {
-			return util.NewForbiddenOperationError(util.MessageProfileNotFound)
+		delete(profile.Textures, textureType)
+		if textureType == "SKIN_HD" {
+			profile.HdSkinSize = 0
 		}
-		profile = p
+	} else {
+		return util.NewForbiddenOperationError(util.MessageProfileNotFound)
 	}
-	return t.db.Transaction(func(tx *gorm.DB) error {
+	err = t.db.Transaction(func(tx *gorm.DB) error {
 		texture := model.Texture{}
 		if err := tx.Select("hash", "used").First(&texture, "hash = ?", hash).Error; err == nil {
 			if texture.Used < 2 {
@@ -185,9 +259,170 @@ func (t *textureServiceImpl) DeleteTexture(accessToken string, profileId uuid.UU
 				tx.Model(&texture).Update("used", gorm.Expr("used - ?", 1))
 			}
 		}
-		user.SetProfile(profile)
+		if err := user.SetProfile(profile); err != nil {
+			return err
+		}
+		if err := tx.Delete(&model.UserTexture{}, "user_id = ? AND texture_type = ?", user.ID, textureType).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&model.TextureHistory{UserID: user.ID, TextureType: textureType, OldHash: hash}).Error; err != nil {
+			return err
+		}
 		return tx.Save(&user).Error
 	})
+	if err != nil {
+		return err
+	}
+	t.tokenService.UpdateProfile(profileId, profile)
+	t.profileCache.Invalidate(profileId)
+	return nil
+}
+
+// TextureHistory 查询自己角色最近的材质变更记录
+func (t *textureServiceImpl) TextureHistory(accessToken string, profileId uuid.UUID) ([]TextureHistoryEntry, error) {
+	token, ok := t.tokenService.GetToken(accessToken)
+	if !ok || token.GetAvailableLevel() != model.Valid {
+		return nil, util.NewForbiddenOperationError(util.MessageInvalidToken)
+	}
+	if token.SelectedProfile.Id != profileId {
+		return nil, util.NewForbiddenOperationError("Profile mismatch.")
+	}
+	return queryTextureHistory(t.db, profileId)
+}
+
+// queryTextureHistory 按时间倒序返回最近 MaxTextureHistory 条材质变更记录
+func queryTextureHistory(db *gorm.DB, userId uuid.UUID) ([]TextureHistoryEntry, error) {
+	var histories []model.TextureHistory
+	if err := db.Where("user_id = ?", userId).Order("id DESC").Limit(MaxTextureHistory).Find(&histories).Error; err != nil {
+		return nil, err
+	}
+	response := make([]TextureHistoryEntry, 0, len(histories))
+	for _, history := range histories {
+		response = append(response, TextureHistoryEntry{
+			Type:      history.TextureType,
+			OldHash:   history.OldHash,
+			NewHash:   history.NewHash,
+			CreatedAt: history.CreatedAt,
+		})
+	}
+	return response, nil
+}
+
+// imageSignatures 允许上传的图像格式及其文件头, 键与 image.DecodeConfig 返回的格式名一致
+var imageSignatures = map[string][]byte{
+	"png":  []byte("\x89PNG\r\n\x1a\n"),
+	"jpeg": {0xff, 0xd8, 0xff},
+}
+
+// IsSupportedImageType 检查图像格式是否可以出现在 AllowedImageTypes 中
+func IsSupportedImageType(format string) bool {
+	_, ok := imageSignatures[format]
+	return ok
+}
+
+func fileTooLargeError(maxBytes int64) error {
+	return util.NewIllegalArgumentError(fmt.Sprintf("File too large(more than %d bytes)", maxBytes))
+}
+
+// decodeTexture 先检查文件头和图像尺寸, 通过后才解码整张图像; 读取超过该材质类型的大小上限时返回错误
+func (t *textureServiceImpl) decodeTexture(src io.Reader, textureType string) (image.Image, error) {
+	defer textureOpDuration.ObserveSince(time.Now(), normalizeTextureType(textureType), "decode")
+	maxBytes := t.cfg.MaxBytes(textureType)
+	reader := &io.LimitedReader{R: src, N: maxBytes + 1}
+	magic := make([]byte, 8)
+	n, _ := io.ReadFull(reader, magic)
+	magic = magic[:n]
+	format := ""
+	for _, allowed := range t.cfg.AllowedImageTypes {
+		if signature, ok := imageSignatures[allowed]; ok && bytes.HasPrefix(magic, signature) {
+			format = allowed
+			break
+		}
+	}
+	if format == "" {
+		return nil, util.NewIllegalArgumentError("Unsupported image type")
+	}
+	var header bytes.Buffer
+	conf, decodedFormat, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(magic), io.TeeReader(reader, &header)))
+	if reader.N == 0 {
+		return nil, fileTooLargeError(maxBytes)
+	}
+	if err != nil || decodedFormat != format {
+		return nil, util.NewIllegalArgumentError("Invalid image")
+	}
+	if err := t.checkDimension(conf, textureType); err != nil {
+		return nil, err
+	}
+	im, _, err := image.Decode(io.MultiReader(bytes.NewReader(magic), &header, reader))
+	if reader.N == 0 {
+		return nil, fileTooLargeError(maxBytes)
+	}
+	if err != nil {
+		return nil, util.NewIllegalArgumentError("Invalid image")
+	}
+	return im, nil
+}
+
+// normalizeTextureType 转换为大写的材质类型, 未知类型视为 SKIN
+func normalizeTextureType(textureType string) string {
+	textureType = strings.ToUpper(textureType)
+	if textureType != "SKIN" && textureType != "SKIN_HD" && textureType != "CAPE" && textureType != "ELYTRA" {
+		textureType = "SKIN"
+	}
+	return textureType
+}
+
+// checkDimension 在解码整张图像前按尺寸拒绝过大的材质, 材质宽度不小于高度
+func (t *textureServiceImpl) checkDimension(conf image.Config, textureType string) error {
+	if strings.EqualFold(textureType, "SKIN_HD") {
+		// 高清皮肤为正方形, 边长是 64 的整数倍且大于普通皮肤的 64
+		if conf.Width != conf.Height || conf.Width%64 != 0 || conf.Width <= 64 || conf.Width > t.cfg.MaxHdSkinSize {
+			return util.NewIllegalArgumentError(fmt.Sprintf("HD skin must be square, a multiple of 64 and between 128 and %d pixels wide", t.cfg.MaxHdSkinSize))
+		}
+		return nil
+	}
+	maxWidth := t.cfg.MaxSkinSize
+	if textureType = strings.ToUpper(textureType); textureType == "CAPE" || textureType == "ELYTRA" {
+		maxWidth = t.cfg.MaxCapeSize
+	}
+	if maxWidth <= 0 || maxWidth > MaxTextureDimension {
+		maxWidth = MaxTextureDimension
+	}
+	if conf.Width > maxWidth || conf.Height > conf.Width {
+		return util.NewIllegalArgumentError(fmt.Sprintf("Image too large(max %d pixels wide, height not exceeding width)", maxWidth))
+	}
+	return nil
+}
+
+// scanTexture 将材质交给外部服务审查, 审查服务出错时按 ScanFailOpen 决定是否放行
+func (t *textureServiceImpl) scanTexture(data []byte, userId uuid.UUID) error {
+	if len(t.cfg.ScanUrl) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), t.cfg.ScanTimeout)
+	defer cancel()
+	result := ScanResult{}
+	if err := util.PostBytesWithContext(ctx, t.cfg.ScanUrl, "image/png", data, &result); err != nil {
+		if t.cfg.ScanFailOpen {
+			log.Printf("材质审查失败, 已放行用户 %s 上传的材质: %s\n", userId.String(), err.Error())
+			return nil
+		}
+		log.Printf("材质审查失败, 已拒绝用户 %s 上传的材质: %s\n", userId.String(), err.Error())
+		return util.YggdrasilError{
+			Status:       http.StatusServiceUnavailable,
+			ErrorCode:    "ServiceUnavailableException",
+			ErrorMessage: "Texture scan is unavailable, please try again later.",
+		}
+	}
+	if !result.Allowed {
+		log.Printf("用户 %s 上传的材质未通过审查: %s\n", userId.String(), result.Reason)
+		message := "Texture rejected by content scan"
+		if len(result.Reason) > 0 {
+			message += ": " + result.Reason
+		}
+		return util.NewForbiddenOperationError(message)
+	}
+	return nil
 }
 
 func (t *textureServiceImpl) saveTexture(user *model.User, skinImage image.Image, textureType string, modelType *model.ModelType) error {
@@ -197,9 +432,16 @@ func (t *textureServiceImpl) saveTexture(user *model.User, skinImage image.Image
 	} else {
 		modelValue = model.STEVE
 	}
-	textureType = strings.ToUpper(textureType)
-	if textureType != "SKIN" && textureType != "CAPE" {
-		textureType = "SKIN"
+	textureType = normalizeTextureType(textureType)
+	defer textureOpDuration.ObserveSince(time.Now(), textureType, "save")
+	encodeStart := time.Now()
+	buffer := bytes.Buffer{}
+	if err := png.Encode(&buffer, skinImage); err != nil {
+		return err
+	}
+	textureOpDuration.ObserveSince(encodeStart, textureType, "encode")
+	if err := t.scanTexture(buffer.Bytes(), user.ID); err != nil {
+		return err
 	}
 	return t.db.Transaction(func(tx *gorm.DB) error {
 		profile, err := user.Profile()
@@ -208,26 +450,26 @@ func (t *textureServiceImpl) saveTexture(user *model.User, skinImage image.Image
 		}
 		if textureType == "SKIN" {
 			profile.ModelType = modelValue
+		} else if textureType == "SKIN_HD" {
+			profile.HdSkinSize = skinImage.Bounds().Dx()
 		}
+		hashStart := time.Now()
 		hash := model.ComputeTextureId(skinImage)
+		textureOpDuration.ObserveSince(hashStart, textureType, "hash")
+		if !t.cfg.Deduplicate {
+			hash = model.ScopedTextureId(hash, user.ID, textureType)
+		}
 		oldHash, oldExist := profile.Textures[textureType]
 		texture := model.Texture{}
 		if err := tx.First(&texture, "hash = ?", hash).Error; err != nil {
 			texture.Hash = hash
 			texture.Used = 1
-			buffer := bytes.Buffer{}
-			err := png.Encode(&buffer, skinImage)
-			if err != nil {
-				return err
-			}
 			texture.Data = buffer.Bytes()
 			if err := tx.Create(&texture).Error; err != nil {
 				return err
 			}
-		} else {
-			if oldExist && oldHash != hash {
-				tx.Model(&texture).Update("used", gorm.Expr("used + ?", 1))
-			}
+		} else if !oldExist || oldHash != hash {
+			tx.Model(&texture).Update("used", gorm.Expr("used + ?", 1))
 		}
 		if oldExist && oldHash != hash {
 			oldTexture := model.Texture{}
@@ -240,7 +482,57 @@ func (t *textureServiceImpl) saveTexture(user *model.User, skinImage image.Image
 			}
 		}
 		profile.Textures[textureType] = hash
-		user.SetProfile(profile)
+		if err := user.SetProfile(profile); err != nil {
+			return err
+		}
+		userTexture := model.UserTexture{UserID: user.ID, TextureType: textureType, Hash: hash}
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}, {Name: "texture_type"}},
+			DoUpdates: clause.AssignmentColumns([]string{"hash"}),
+		}).Create(&userTexture).Error; err != nil {
+			return err
+		}
+		if !oldExist || oldHash != hash {
+			history := model.TextureHistory{UserID: user.ID, TextureType: textureType, OldHash: oldHash, NewHash: hash}
+			if err := tx.Create(&history).Error; err != nil {
+				return err
+			}
+		}
 		return tx.Save(&user).Error
 	})
 }
+
+// MigrateUserTextures user_textures 表为空时根据 users 表中序列化的材质信息填充
+func MigrateUserTextures(db *gorm.DB) error {
+	var count int64
+	if err := db.Model(&model.UserTexture{}).Count(&count).Error; err != nil || count > 0 {
+		return err
+	}
+	migrated := 0
+	var users []model.User
+	err := db.Where("serialized_textures IS NOT NULL AND serialized_textures <> ''").FindInBatches(&users, 100, func(tx *gorm.DB, batch int) error {
+		userTextures := make([]model.UserTexture, 0, len(users))
+		for _, user := range users {
+			profile, err := user.Profile()
+			if err != nil {
+				log.Printf("无法读取用户 %s 的材质信息: %s\n", user.ID.String(), err.Error())
+				continue
+			}
+			for textureType, hash := range profile.Textures {
+				userTextures = append(userTextures, model.UserTexture{UserID: user.ID, TextureType: textureType, Hash: hash})
+			}
+		}
+		if len(userTextures) == 0 {
+			return nil
+		}
+		migrated += len(userTextures)
+		return db.Create(&userTextures).Error
+	}).Error
+	if err != nil {
+		return err
+	}
+	if migrated > 0 {
+		log.Printf("已迁移 %d 条用户材质记录\n", migrated)
+	}
+	return nil
+}
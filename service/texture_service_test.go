@@ -0,0 +1,266 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/uuid"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"yggdrasil-go/model"
+)
+
+func newTestTextureService(cfg TextureCfg) *textureServiceImpl {
+	if len(cfg.AllowedImageTypes) == 0 {
+		cfg.AllowedImageTypes = []string{"png"}
+	}
+	return NewTextureService(nil, nil, nil, cfg).(*textureServiceImpl)
+}
+
+func encodePng(t *testing.T, width int, height int) []byte {
+	t.Helper()
+	buffer := bytes.Buffer{}
+	if err := png.Encode(&buffer, image.NewNRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestDecodeTextureRejectsSpoofedImages(t *testing.T) {
+	validPng := encodePng(t, 64, 64)
+	jpegImage := bytes.Buffer{}
+	if err := jpeg.Encode(&jpegImage, image.NewRGBA(image.Rect(0, 0, 64, 64)), nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"valid png", validPng, ""},
+		{"empty", nil, "Unsupported image type"},
+		{"gif", []byte("GIF89a\x40\x00\x40\x00"), "Unsupported image type"},
+		{"text", []byte("<?php echo 'not a skin'; ?>"), "Unsupported image type"},
+		{"jpeg not allowed", jpegImage.Bytes(), "Unsupported image type"},
+		{"png signature then garbage", append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0x42}, 64)...), "Invalid image"},
+		{"png header then truncated data", validPng[:len(validPng)/2], "Invalid image"},
+	}
+	textureService := newTestTextureService(TextureCfg{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := textureService.decodeTexture(bytes.NewReader(tt.data), "skin")
+			if got := errorMessage(err); got != tt.wantErr {
+				t.Errorf("decodeTexture() error = %q, want %q", got, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeTextureSizeLimit(t *testing.T) {
+	tests := []struct {
+		textureType string
+		data        []byte
+	}{
+		{"skin", encodePng(t, 64, 64)},
+		{"cape", encodePng(t, 64, 32)},
+		{"elytra", encodePng(t, 64, 32)},
+	}
+	for _, tt := range tests {
+		size := int64(len(tt.data))
+		t.Run(tt.textureType, func(t *testing.T) {
+			// 文件恰好等于上限时允许, 另一种材质的上限不影响结果
+			textureService := newTestTextureService(limitFor(tt.textureType, size, size-1))
+			if _, err := textureService.decodeTexture(bytes.NewReader(tt.data), tt.textureType); err != nil {
+				t.Errorf("%d bytes with limit %d: unexpected error %v", size, size, err)
+			}
+			// 超出上限 1 字节时拒绝
+			textureService = newTestTextureService(limitFor(tt.textureType, size-1, size))
+			_, err := textureService.decodeTexture(bytes.NewReader(tt.data), tt.textureType)
+			if got, want := errorMessage(err), errorMessage(fileTooLargeError(size-1)); got != want {
+				t.Errorf("%d bytes with limit %d: error = %q, want %q", size, size-1, got, want)
+			}
+		})
+	}
+}
+
+// limitFor 为 textureType 设置大小上限 limit, 另一类材质设置为 other
+func limitFor(textureType string, limit int64, other int64) TextureCfg {
+	if textureType == "skin" {
+		return TextureCfg{MaxSkinBytes: limit, MaxCapeBytes: other}
+	}
+	return TextureCfg{MaxSkinBytes: other, MaxCapeBytes: limit}
+}
+
+func TestCheckDimension(t *testing.T) {
+	textureService := newTestTextureService(TextureCfg{MaxSkinSize: 64, MaxCapeSize: 64, MaxHdSkinSize: 512})
+	tests := []struct {
+		textureType string
+		width       int
+		height      int
+		valid       bool
+	}{
+		{"skin", 64, 32, true},
+		{"skin", 64, 64, true},
+		{"skin", 128, 128, false},
+		{"skin", 64, 128, false},
+		{"cape", 64, 32, true},
+		{"cape", 128, 64, false},
+		{"skin_hd", 64, 64, false},
+		{"skin_hd", 128, 128, true},
+		{"skin_hd", 192, 192, true},
+		{"skin_hd", 130, 130, false},
+		{"skin_hd", 512, 512, true},
+		{"skin_hd", 576, 576, false},
+		{"skin_hd", 256, 128, false},
+	}
+	for _, tt := range tests {
+		err := textureService.checkDimension(image.Config{Width: tt.width, Height: tt.height}, tt.textureType)
+		if (err == nil) != tt.valid {
+			t.Errorf("checkDimension(%dx%d, %s) error = %v, want valid = %v", tt.width, tt.height, tt.textureType, err, tt.valid)
+		}
+	}
+}
+
+func TestScanTexture(t *testing.T) {
+	var mode string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "image/png" {
+			t.Errorf("scan request content type = %q", r.Header.Get("Content-Type"))
+		}
+		switch mode {
+		case "allow":
+			_, _ = w.Write([]byte(`{"allowed":true}`))
+		case "reject":
+			_, _ = w.Write([]byte(`{"allowed":false,"reason":"nsfw"}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	data := encodePng(t, 64, 64)
+
+	tests := []struct {
+		mode     string
+		failOpen bool
+		wantErr  string
+	}{
+		{"allow", false, ""},
+		{"reject", false, "Texture rejected by content scan: nsfw"},
+		// 审查服务明确拒绝时, fail open 也不能放行
+		{"reject", true, "Texture rejected by content scan: nsfw"},
+		{"error", false, "Texture scan is unavailable, please try again later."},
+		{"error", true, ""},
+	}
+	for _, tt := range tests {
+		mode = tt.mode
+		textureService := newTestTextureService(TextureCfg{ScanUrl: server.URL, ScanTimeout: 5 * time.Second, ScanFailOpen: tt.failOpen})
+		if got := errorMessage(textureService.scanTexture(data, uuid.New())); got != tt.wantErr {
+			t.Errorf("scan %s (fail open %v): error = %q, want %q", tt.mode, tt.failOpen, got, tt.wantErr)
+		}
+	}
+
+	// 审查服务无法连接
+	server.Close()
+	for _, failOpen := range []bool{false, true} {
+		textureService := newTestTextureService(TextureCfg{ScanUrl: server.URL, ScanTimeout: 5 * time.Second, ScanFailOpen: failOpen})
+		err := textureService.scanTexture(data, uuid.New())
+		if (err == nil) != failOpen {
+			t.Errorf("unreachable scanner (fail open %v): error = %v", failOpen, err)
+		}
+	}
+}
+
+func TestSaveTextureDeduplication(t *testing.T) {
+	for _, deduplicate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("deduplicate=%v", deduplicate), func(t *testing.T) {
+			u := newTestUserService(t, newTestDB(t), &fakeMojangClient{})
+			textureService := NewTextureService(u.tokenService, u.profileCache, u.db, TextureCfg{
+				UploadableTextures: []string{"skin"},
+				AllowedImageTypes:  []string{"png"},
+				Deduplicate:        deduplicate,
+			})
+			skin := encodePng(t, 64, 64)
+			alice, aliceToken := createTestUser(t, u, "alice@example.com", "Alice")
+			bob, bobToken := createTestUser(t, u, "bob@example.com", "Bob")
+			for _, upload := range []struct {
+				user  *model.User
+				token *model.Token
+			}{{alice, aliceToken}, {bob, bobToken}} {
+				if err := textureService.UploadTexture(upload.token.AccessToken, upload.user.ID, bytes.NewReader(skin), "skin", nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			aliceHash := storedTextureHash(t, u, alice.ID)
+			bobHash := storedTextureHash(t, u, bob.ID)
+			if (aliceHash == bobHash) != deduplicate {
+				t.Fatalf("alice hash %s, bob hash %s: shared = %v, want %v", aliceHash, bobHash, aliceHash == bobHash, deduplicate)
+			}
+			wantUsed := 1
+			if deduplicate {
+				wantUsed = 2
+			}
+			if used := textureUsed(t, u, bobHash); used != wantUsed {
+				t.Errorf("used = %d, want %d", used, wantUsed)
+			}
+
+			if err := textureService.DeleteTexture(aliceToken.AccessToken, alice.ID, "skin"); err != nil {
+				t.Fatal(err)
+			}
+			// 删除一个用户的材质不影响另一个用户
+			if _, err := textureService.GetTexture(bobHash); err != nil {
+				t.Fatalf("bob's texture was removed with alice's: %v", err)
+			}
+			if used := textureUsed(t, u, bobHash); used != 1 {
+				t.Errorf("used after delete = %d, want 1", used)
+			}
+			if !deduplicate {
+				if _, err := textureService.GetTexture(aliceHash); err == nil {
+					t.Error("alice's scoped texture still stored after delete")
+				}
+			}
+		})
+	}
+}
+
+func storedTextureHash(t *testing.T, u *userServiceImpl, userId uuid.UUID) string {
+	t.Helper()
+	user := model.User{}
+	if err := u.db.First(&user, userId).Error; err != nil {
+		t.Fatal(err)
+	}
+	profile, err := user.Profile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return profile.Textures["SKIN"]
+}
+
+func textureUsed(t *testing.T, u *userServiceImpl, hash string) int {
+	t.Helper()
+	texture := model.Texture{}
+	if err := u.db.Select("hash", "used").First(&texture, "hash = ?", hash).Error; err != nil {
+		t.Fatal(err)
+	}
+	return int(texture.Used)
+}
@@ -20,6 +20,10 @@ package service
 import (
 	"github.com/google/uuid"
 	lru "github.com/hashicorp/golang-lru"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 	"yggdrasil-go/model"
 	"yggdrasil-go/util"
 )
@@ -27,61 +31,163 @@ import (
 type TokenService interface {
 	RemoveToken(token *model.Token)
 	RemoveAccessToken(accessToken string)
-	RemoveAll(profileId uuid.UUID)
-	AcquireToken(user *model.User, clientToken *string, profile *model.Profile) *model.Token
+	RemoveAll(profileId uuid.UUID) int
+	Purge() int
+	AcquireToken(user *model.User, clientToken *string, profile *model.Profile) (*model.Token, error)
+	RotateToken(token *model.Token, user *model.User, clientToken *string) (*model.Token, error)
+	DetectReuse(accessToken string) bool
 	VerifyToken(accessToken string, clientToken *string) model.AvailableLevel
 	GetToken(accessToken string) (*model.Token, bool)
 	UpdateProfile(profileId uuid.UUID, profile *model.Profile)
 }
 
+type TokenCfg struct {
+	// RequireClientToken 为 true 时, 校验令牌必须提供与之绑定的 clientToken
+	RequireClientToken bool `ini:"require_client_token"`
+	// ValidDuration 令牌签发后无需刷新即可使用的时长, 之后客户端需要刷新令牌
+	ValidDuration time.Duration `ini:"valid_duration"`
+	// RefreshDuration 令牌签发后仍可刷新的时长, 之后令牌失效, 需要重新登录, 不小于 ValidDuration
+	RefreshDuration time.Duration `ini:"refresh_duration"`
+}
+
 type tokenStore struct {
+	cfg        TokenCfg
 	tokenCache *lru.Cache
+	// rotatedCache 记录已被刷新替换的 accessToken 及其所属令牌族
+	rotatedCache *lru.Cache
+	// mu 保护对缓存的写操作, 已缓存的 *model.Token 不会被原地修改, 只会被替换
+	mu sync.Mutex
+	// removing 为 true 时令牌正在被主动移除, 而不是因缓存已满被淘汰, 由 mu 保护
+	removing  bool
+	evictions int64
 }
 
-func NewTokenService() TokenService {
-	cache, _ := lru.New(10000000)
+func NewTokenService(cfg TokenCfg, cacheCfg CacheCfg) TokenService {
 	store := tokenStore{
-		tokenCache: cache,
+		cfg: cfg,
 	}
+	store.tokenCache, _ = lru.NewWithEvict(cacheCfg.TokenCacheSize, store.onEvicted)
+	store.rotatedCache, _ = lru.New(cacheCfg.RotatedTokenCacheSize)
+	util.RegisterCounter("yggdrasil_token_cache_evictions_total", "Number of tokens evicted because the token cache was full.", func() float64 {
+		return float64(atomic.LoadInt64(&store.evictions))
+	})
 	return &store
 }
 
+// onEvicted 令牌因缓存已满被淘汰时, 对应的玩家会被迫重新登录
+func (t *tokenStore) onEvicted(_ interface{}, value interface{}) {
+	if t.removing {
+		return
+	}
+	atomic.AddInt64(&t.evictions, 1)
+	if token, ok := value.(*model.Token); ok {
+		log.Printf("令牌缓存已满, 已淘汰角色 %s 的令牌\n", token.SelectedProfile.Name)
+	}
+}
+
+// remove 主动移除令牌, 调用方需持有 mu
+func (t *tokenStore) remove(accessToken interface{}) {
+	t.removing = true
+	defer func() { t.removing = false }()
+	t.tokenCache.Remove(accessToken)
+}
+
 func (t *tokenStore) RemoveToken(token *model.Token) {
 	t.RemoveAccessToken(token.AccessToken)
 }
 
 func (t *tokenStore) RemoveAccessToken(accessToken string) {
-	t.tokenCache.Remove(accessToken)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remove(accessToken)
 }
 
-func (t *tokenStore) RemoveAll(profileId uuid.UUID) {
+func (t *tokenStore) RemoveAll(profileId uuid.UUID) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	removed := 0
 	keys := t.tokenCache.Keys()
 	for _, k := range keys {
 		if v, ok := t.tokenCache.Get(k); ok {
 			if v.(*model.Token).SelectedProfile.Id == profileId {
-				t.tokenCache.Remove(k)
+				t.remove(k)
+				removed++
 			}
 		}
 	}
+	return removed
 }
 
-func (t *tokenStore) AcquireToken(user *model.User, clientToken *string, profile *model.Profile) *model.Token {
+// Purge 吊销所有令牌, 返回吊销的数量
+func (t *tokenStore) Purge() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	removed := t.tokenCache.Len()
+	t.removing = true
+	defer func() { t.removing = false }()
+	t.tokenCache.Purge()
+	return removed
+}
+
+func (t *tokenStore) AcquireToken(user *model.User, clientToken *string, profile *model.Profile) (*model.Token, error) {
 	if profile == nil {
 		var err error
 		profile, err = user.Profile()
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 	}
-	token := model.NewToken(util.RandomUUID(), clientToken, profile)
+	token := model.NewToken(util.RandomUUID(), clientToken, profile, t.cfg.ValidDuration, t.cfg.RefreshDuration)
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	t.tokenCache.Add(token.AccessToken, &token)
-	return &token
+	return &token, nil
+}
+
+// RotateToken 签发与 token 同族的新令牌, 并将旧令牌标记为已替换
+func (t *tokenStore) RotateToken(token *model.Token, user *model.User, clientToken *string) (*model.Token, error) {
+	profile, err := user.Profile()
+	if err != nil {
+		return nil, err
+	}
+	newToken := model.NewToken(util.RandomUUID(), clientToken, profile, t.cfg.ValidDuration, t.cfg.RefreshDuration)
+	newToken.Family = token.Family
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokenCache.Add(newToken.AccessToken, &newToken)
+	t.remove(token.AccessToken)
+	t.rotatedCache.Add(token.AccessToken, token.Family)
+	return &newToken, nil
+}
+
+// DetectReuse 检查 accessToken 是否为已被替换的旧令牌, 若是则吊销整个令牌族
+func (t *tokenStore) DetectReuse(accessToken string) bool {
+	value, ok := t.rotatedCache.Get(accessToken)
+	if !ok {
+		return false
+	}
+	family := value.(string)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	revoked := 0
+	for _, k := range t.tokenCache.Keys() {
+		if v, ok := t.tokenCache.Peek(k); ok && v.(*model.Token).Family == family {
+			t.remove(k)
+			revoked++
+		}
+	}
+	log.Printf("安全警告: 已刷新的令牌被重复使用, 已吊销令牌族 %s 中的 %d 个令牌", family, revoked)
+	return true
 }
 
 func (t *tokenStore) VerifyToken(accessToken string, clientToken *string) model.AvailableLevel {
 	if value, ok := t.tokenCache.Get(accessToken); ok {
 		if token, ok := value.(*model.Token); ok {
-			if clientToken != nil && token.ClientToken != *clientToken {
+			if clientToken == nil || *clientToken == "" {
+				if t.cfg.RequireClientToken {
+					return model.Invalid
+				}
+			} else if token.ClientToken != *clientToken {
 				return model.Invalid
 			}
 			if token.GetAvailableLevel() == model.Invalid {
@@ -103,11 +209,16 @@ func (t *tokenStore) GetToken(accessToken string) (*model.Token, bool) {
 }
 
 func (t *tokenStore) UpdateProfile(profileId uuid.UUID, profile *model.Profile) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	keys := t.tokenCache.Keys()
 	for _, k := range keys {
-		if v, ok := t.tokenCache.Get(k); ok {
+		if v, ok := t.tokenCache.Peek(k); ok {
 			if token := v.(*model.Token); token.SelectedProfile.Id == profileId {
-				token.SelectedProfile = *profile
+				// 其他协程可能正在读取旧的 token, 因此替换为副本而不是原地修改
+				updated := *token
+				updated.SelectedProfile = *profile
+				t.tokenCache.Add(k, &updated)
 			}
 		}
 	}
@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"sync"
+	"testing"
+	"yggdrasil-go/model"
+)
+
+// TestTokenConcurrentVerifyAndUpdateProfile 需配合 go test -race 运行, 验证 UpdateProfile 不会与读取令牌的协程产生数据竞争
+func TestTokenConcurrentVerifyAndUpdateProfile(t *testing.T) {
+	tokenService := NewTokenService(TokenCfg{
+		ValidDuration:   model.DefaultTokenValidDuration,
+		RefreshDuration: model.DefaultTokenRefreshDuration,
+	}, DefaultCacheCfg())
+	user := &model.User{ID: uuid.New(), ProfileName: "Tester"}
+	token, err := tokenService.AcquireToken(user, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const rounds = 500
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				if level := tokenService.VerifyToken(token.AccessToken, nil); level != model.Valid {
+					t.Errorf("VerifyToken() = %v, want Valid", level)
+					return
+				}
+				if current, ok := tokenService.GetToken(token.AccessToken); !ok || current.SelectedProfile.Id != user.ID {
+					t.Errorf("GetToken() lost the selected profile")
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < rounds; j++ {
+			profile, err := model.NewProfile(user.ID, fmt.Sprintf("Tester%d", j), model.STEVE, "")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			tokenService.UpdateProfile(user.ID, &profile)
+		}
+	}()
+	wg.Wait()
+
+	current, ok := tokenService.GetToken(token.AccessToken)
+	if !ok {
+		t.Fatal("token evicted")
+	}
+	if want := fmt.Sprintf("Tester%d", rounds-1); current.SelectedProfile.Name != want {
+		t.Errorf("profile name = %q, want %q", current.SelectedProfile.Name, want)
+	}
+	// 调用方持有的旧令牌不应被原地修改
+	if token.SelectedProfile.Name != "Tester" {
+		t.Errorf("original token mutated: profile name = %q", token.SelectedProfile.Name)
+	}
+}
+
+func TestVerifyTokenRequireClientToken(t *testing.T) {
+	empty := ""
+	matching := "client-token"
+	other := "other-client-token"
+	tests := []struct {
+		name               string
+		requireClientToken bool
+		clientToken        *string
+		want               model.AvailableLevel
+	}{
+		{"optional, nil", false, nil, model.Valid},
+		{"optional, empty", false, &empty, model.Valid},
+		{"optional, matching", false, &matching, model.Valid},
+		{"optional, mismatched", false, &other, model.Invalid},
+		{"required, nil", true, nil, model.Invalid},
+		{"required, empty", true, &empty, model.Invalid},
+		{"required, matching", true, &matching, model.Valid},
+		{"required, mismatched", true, &other, model.Invalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokenService := NewTokenService(TokenCfg{
+				RequireClientToken: tt.requireClientToken,
+				ValidDuration:      model.DefaultTokenValidDuration,
+				RefreshDuration:    model.DefaultTokenRefreshDuration,
+			}, DefaultCacheCfg())
+			token, err := tokenService.AcquireToken(&model.User{ID: uuid.New(), ProfileName: "Tester"}, &matching, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tokenService.VerifyToken(token.AccessToken, tt.clientToken); got != tt.want {
+				t.Errorf("VerifyToken() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -22,24 +22,25 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
-	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	lru "github.com/hashicorp/golang-lru"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/time/rate"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
 	"net/http"
-	"net/url"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 	"yggdrasil-go/model"
 	"yggdrasil-go/util"
 )
 
 type UserService interface {
-	Register(username string, password string, profileName string) (*model.UserResponse, error)
+	Register(username string, password string, profileName string, inviteCode string, ip string) (*model.UserResponse, error)
 	Login(username string, password string, clientToken *string, requestUser bool) (*LoginResponse, error)
 	ChangeProfile(accessToken string, clientToken *string, changeTo string) error
 	Refresh(accessToken string, clientToken *string, requestUser bool, selectedProfile *model.ProfileResponse) (*LoginResponse, error)
@@ -48,8 +49,18 @@ type UserService interface {
 	Signout(username string, password string) error
 	UsernameToUUID(username string) (*model.ProfileResponse, error)
 	QueryUUIDs(usernames []string) ([]model.ProfileResponse, error)
+	QueryUUIDsDetailed(usernames []string) ([]BulkLookupResult, error)
 	QueryProfile(profileId uuid.UUID, unsigned bool, textureBaseUrl string) (map[string]interface{}, error)
+	QueryProfiles(usernames []string, unsigned bool, textureBaseUrl string) ([]map[string]interface{}, error)
+	QueryProfilesDetailed(usernames []string, unsigned bool, textureBaseUrl string) ([]BulkLookupResult, error)
 	ProfileKey(accessToken string) (*ProfileKeyResponse, error)
+	TokenInfo(accessToken string) (*TokenInfoResponse, error)
+	RevokeProfileKey(accessToken string) error
+	ExportProfile(accessToken string, textureBaseUrl string) (*ExportResponse, error)
+	PlayerAttributes(accessToken string) (*PlayerAttributesResponse, error)
+	BlockList(accessToken string) (*BlockListResponse, error)
+	BlockPlayer(accessToken string, blockedId uuid.UUID) error
+	UnblockPlayer(accessToken string, blockedId uuid.UUID) error
 }
 
 type LoginResponse struct {
@@ -68,76 +79,395 @@ type ProfileKeyResponse struct {
 	RefreshedAfter       time.Time       `json:"refreshedAfter,omitempty"`
 }
 
+type TokenInfoResponse struct {
+	AvailableLevel string    `json:"availableLevel"`
+	RefreshAt      time.Time `json:"refreshAt"`
+	ExpiresAt      time.Time `json:"expiresAt"`
+	RefreshIn      int64     `json:"refreshIn"`
+	ExpiresIn      int64     `json:"expiresIn"`
+}
+
+type ExportResponse struct {
+	Email     string                 `json:"email"`
+	CreatedAt time.Time              `json:"createdAt"`
+	Profile   map[string]interface{} `json:"profile"`
+}
+
+// BulkLookupResult 批量查询中单个角色名的结果
+type BulkLookupResult struct {
+	Name string `json:"name"`
+	// Status found, upstream (本地不存在, 由 Mojang 查询得到), not_found 或 error
+	Status  string      `json:"status"`
+	Profile interface{} `json:"profile,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+const (
+	LookupFound    = "found"
+	LookupUpstream = "upstream"
+	LookupNotFound = "not_found"
+	LookupError    = "error"
+)
+
+// MaxBulkProfileLookup 批量查询完整角色信息时单次请求的角色名上限 (去重后)
+const MaxBulkProfileLookup = 10
+
 type ProfileKeyPair struct {
 	PrivateKey string `json:"privateKey,omitempty"`
 	PublicKey  string `json:"publicKey,omitempty"`
 }
 
+type UserCfg struct {
+	// RegistrationOpen 是否开放注册, 运行时可通过管理接口或 SIGHUP 重新读取配置修改
+	RegistrationOpen bool `ini:"registration_open"`
+	// RequireInviteCode 注册时必须提供有效的邀请码, 邀请码通过管理接口创建
+	RequireInviteCode bool `ini:"require_invite_code"`
+	// RegisterLimitPerIp 每个 IP 每小时最多可注册的账号数, 0 表示不限制
+	RegisterLimitPerIp int `ini:"register_limit_per_ip"`
+	// ProfileKeyPoolSize 预先生成的玩家证书密钥对数量
+	ProfileKeyPoolSize int `ini:"profile_key_pool_size"`
+	// ProfileKeyGenerators 同时生成密钥对的协程数
+	ProfileKeyGenerators int `ini:"profile_key_generators"`
+	// ProfileKeyHighWater 密钥对池达到该数量后暂停生成, 0 表示等于 ProfileKeyPoolSize
+	ProfileKeyHighWater int `ini:"profile_key_high_water"`
+	// ProfileKeyLowWater 暂停后密钥对池低于该数量时才恢复生成, 0 表示 ProfileKeyHighWater 的一半 (至少为 1)
+	ProfileKeyLowWater int `ini:"profile_key_low_water"`
+	// ProfileKeyGenInterval 每个协程连续生成两个密钥对之间的间隔, 用于限制 CPU 占用
+	ProfileKeyGenInterval time.Duration `ini:"profile_key_gen_interval"`
+	// OfflineMode 危险: 登录未注册的邮箱时自动创建账号, 仅用于局域网或 CI 测试
+	OfflineMode bool `ini:"offline_mode"`
+	// OfflineModeSecret 离线模式下自动创建账号时要求的共享密码, 为空时不校验
+	OfflineModeSecret string `ini:"offline_mode_secret"`
+	// RegisterApproval 新注册的账号需要管理员审核通过后才能登录
+	RegisterApproval bool `ini:"register_approval"`
+	// AuthMinResponseTime 登录/登出接口的最短响应时间, 避免通过耗时判断用户是否存在, 0 表示不等待
+	AuthMinResponseTime time.Duration `ini:"auth_min_response_time"`
+	// BcryptCost 密码哈希的计算强度, 调高后旧密码会在用户下次登录时重新哈希
+	BcryptCost int `ini:"bcrypt_cost"`
+	// UuidStrategy 注册时生成角色 UUID 的方式: random 随机, offline 与原版离线模式服务器相同 (由角色名计算)
+	UuidStrategy string `ini:"uuid_strategy"`
+	// SupportUrl 账号被限制或等待审核时在错误信息的 cause 字段中提供的联系/申诉地址, 为空时不提供
+	SupportUrl string `ini:"support_url"`
+	// ReservedNamesList 禁止使用的角色名, 支持通配符和 re: 开头的正则表达式
+	ReservedNamesList []string `ini:"reserved_names"`
+	// ReservedNamesFile 禁止使用的角色名列表文件, 每行一个
+	ReservedNamesFile string `ini:"reserved_names_file"`
+	// ReservedNames 由 ReservedNamesList 和 ReservedNamesFile 解析得到
+	ReservedNames ReservedNames `ini:"-"`
+	// MojangNameCheck 注册/改名时是否禁止使用已有正版账号的角色名: off 不检查,
+	// allow 检查但 Mojang 不可用时放行, deny 检查且 Mojang 不可用时拒绝
+	MojangNameCheck string `ini:"mojang_name_check"`
+	// UpstreamProfileLookup 批量查询完整角色信息时, 本地不存在的角色名转发到 Mojang 查询
+	UpstreamProfileLookup bool `ini:"upstream_profile_lookup"`
+	// PasswordPolicy 密码复杂度规则, 读取自 [password] 配置节
+	PasswordPolicy PasswordPolicy `ini:"-"`
+	// Privileges 玩家权限, 读取自 [privileges] 配置节
+	Privileges PrivilegesCfg `ini:"-"`
+}
+
+// ResolveKeyPoolWaterMarks 填充密钥对池高低水位的默认值并检查取值范围;
+// 启用暂停时低水位至少为 1, 否则池被取空后生成协程不会被唤醒
+func (c *UserCfg) ResolveKeyPoolWaterMarks() error {
+	if c.ProfileKeyHighWater == 0 {
+		c.ProfileKeyHighWater = c.ProfileKeyPoolSize
+	}
+	if c.ProfileKeyLowWater == 0 {
+		c.ProfileKeyLowWater = c.ProfileKeyHighWater / 2
+		if c.ProfileKeyLowWater < 1 && c.ProfileKeyHighWater > 0 {
+			c.ProfileKeyLowWater = 1
+		}
+	}
+	if c.ProfileKeyHighWater < 0 || c.ProfileKeyHighWater > c.ProfileKeyPoolSize ||
+		c.ProfileKeyLowWater < 0 || c.ProfileKeyLowWater > c.ProfileKeyHighWater ||
+		(c.ProfileKeyHighWater > 0 && c.ProfileKeyLowWater < 1) {
+		return fmt.Errorf("profile_key_low_water (%d) and profile_key_high_water (%d) must satisfy 1 <= low <= high <= profile_key_pool_size (%d)",
+			c.ProfileKeyLowWater, c.ProfileKeyHighWater, c.ProfileKeyPoolSize)
+	}
+	if c.ProfileKeyGenInterval < 0 {
+		return fmt.Errorf("profile_key_gen_interval must not be negative")
+	}
+	return nil
+}
+
 type userServiceImpl struct {
 	tokenService    TokenService
+	mojangClient    MojangClient
+	profileCache    ProfileCache
 	db              *gorm.DB
-	limitLruCache   *lru.Cache
+	cfg             UserCfg
+	userLimiter     RateLimiter
+	registerLimiter RateLimiter
+	textureCfg      TextureCfg
 	profileKeyCache *lru.Cache
 	keyPairCh       chan ProfileKeyPair
+	keyPairRefill   chan struct{}
+	// keyPairGenerator 生成角色密钥对, 默认为 newProfileKeyPair, 测试中可替换
+	keyPairGenerator func() (ProfileKeyPair, error)
+	// keyPairRetryDelay 生成密钥对失败后的重试间隔
+	keyPairRetryDelay time.Duration
+	dummyHash         []byte
 }
 
-func NewUserService(tokenService TokenService, db *gorm.DB) UserService {
-	cache0, _ := lru.New(10000)
-	cache1, _ := lru.New(10000)
-	ch := make(chan ProfileKeyPair, 100)
+func NewUserService(tokenService TokenService, mojangClient MojangClient, profileCache ProfileCache, db *gorm.DB, cfg UserCfg, rateLimitCfg RateLimitCfg, textureCfg TextureCfg, cacheCfg CacheCfg) UserService {
+	cache1, _ := lru.New(cacheCfg.ProfileKeyCacheSize)
+	ch := make(chan ProfileKeyPair, cfg.ProfileKeyPoolSize)
+	// 用户不存在时也执行一次 bcrypt 比较, 使耗时与密码错误时一致
+	dummyHash, _ := bcrypt.GenerateFromPassword([]byte(util.RandomUUID()), cfg.BcryptCost)
 	userService := userServiceImpl{
-		tokenService:    tokenService,
-		db:              db,
-		limitLruCache:   cache0,
-		profileKeyCache: cache1,
-		keyPairCh:       ch,
+		tokenService:      tokenService,
+		mojangClient:      mojangClient,
+		profileCache:      profileCache,
+		db:                db,
+		cfg:               cfg,
+		userLimiter:       NewRateLimiter(rateLimitCfg, cacheCfg, db, 0.2, 3),
+		textureCfg:        textureCfg,
+		profileKeyCache:   cache1,
+		keyPairCh:         ch,
+		keyPairRefill:     make(chan struct{}, cfg.ProfileKeyGenerators),
+		keyPairGenerator:  newProfileKeyPair,
+		keyPairRetryDelay: time.Second,
+		dummyHash:         dummyHash,
+	}
+	if cfg.RegisterLimitPerIp > 0 {
+		userService.registerLimiter = NewRateLimiter(rateLimitCfg, cacheCfg, db, rate.Limit(float64(cfg.RegisterLimitPerIp)/3600), cfg.RegisterLimitPerIp)
+	}
+	util.RegisterGauge("yggdrasil_profile_key_pool_depth", "Number of pre-generated profile key pairs available.", func() float64 {
+		return float64(len(ch))
+	})
+	util.RegisterGauge("yggdrasil_profile_key_pool_capacity", "Capacity of the pre-generated profile key pair pool.", func() float64 {
+		return float64(cap(ch))
+	})
+	if cfg.OfflineMode {
+		log.Println("警告: 已开启离线模式, 任何人都可以通过登录自动创建账号, 请勿在公开服务器上使用!")
+	}
+	// 启动后立即在后台填满密钥对池
+	for i := 0; i < cfg.ProfileKeyGenerators; i++ {
+		go userService.genKeyPair()
 	}
-	go userService.genKeyPair()
 	return &userService
 }
 
-func (u *userServiceImpl) Register(username string, password string, profileName string) (*model.UserResponse, error) {
-	var count int64
-	if err := u.db.Table("users").Where("email = ?", username).Count(&count).Error; err != nil {
-		return nil, err
+var registrationOpen int32 = 1
+
+func init() {
+	util.RegisterGauge("yggdrasil_registration_open", "Whether registration is open (1) or closed (0).", func() float64 {
+		return float64(atomic.LoadInt32(&registrationOpen))
+	})
+}
+
+// SetRegistrationOpen 开放或关闭注册, 关闭后其他功能不受影响
+func SetRegistrationOpen(open bool) {
+	var value int32
+	if open {
+		value = 1
 	}
-	if count > 0 {
-		return nil, util.NewForbiddenOperationError("email exist")
+	atomic.StoreInt32(&registrationOpen, value)
+}
+
+func RegistrationOpen() bool {
+	return atomic.LoadInt32(&registrationOpen) == 1
+}
+
+func (u *userServiceImpl) Register(username string, password string, profileName string, inviteCode string, ip string) (*model.UserResponse, error) {
+	if !RegistrationOpen() {
+		return nil, u.withSupportUrl(util.NewForbiddenOperationError("Registration is closed"))
 	}
+	if u.registerLimiter != nil && !u.registerLimiter.Allow("register:"+ip) {
+		return nil, u.withSupportUrl(util.YggdrasilError{
+			Status:       http.StatusTooManyRequests,
+			ErrorCode:    "ForbiddenOperationException",
+			ErrorMessage: "Too many registrations from this address",
+		})
+	}
+	var count int64
 	if err := u.db.Table("users").Where("profile_name = ?", profileName).Count(&count).Error; err != nil {
 		return nil, err
 	}
 	if count > 0 {
 		return nil, util.NewForbiddenOperationError("profileName exist")
-	} else if _, err := mojangUsernameToUUID(profileName); err == nil {
-		return nil, util.NewForbiddenOperationError("profileName duplicate")
+	} else if err := u.checkMojangName(profileName); err != nil {
+		return nil, err
 	}
 	matched, err := regexp.MatchString("^(\\w){3,}(\\.\\w+)*@(\\w){2,}((\\.\\w+)+)$", username)
 	if err != nil {
 		return nil, err
 	}
-	if !matched || len(password) < 6 || isInvalidProfileName(profileName) {
-		return nil, util.NewIllegalArgumentError("bad format(valid email, password longer than 5, profileName longer than 1)")
+	if !matched || isInvalidProfileName(profileName) {
+		return nil, util.NewIllegalArgumentError("bad format(valid email, profileName longer than 1)")
 	}
-	hashedPass, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
+	if u.cfg.ReservedNames.Contains(profileName) {
+		return nil, util.NewForbiddenOperationError("profileName reserved")
+	}
+	if err := u.cfg.PasswordPolicy.Check(username, password); err != nil {
 		return nil, err
 	}
-	user := model.User{
-		ID:       uuid.New(),
-		Email:    username,
-		Password: string(hashedPass),
+	if u.cfg.RequireInviteCode && len(inviteCode) == 0 {
+		return nil, util.NewIllegalArgumentError("inviteCode is required")
+	}
+	user, err := u.newUser(username, password, profileName)
+	if err != nil {
+		return nil, err
 	}
-	profile := model.NewProfile(user.ID, profileName, model.STEVE, "")
-	user.SetProfile(&profile)
+	user.Pending = u.cfg.RegisterApproval
 
-	if err := u.db.Create(&user).Error; err != nil {
+	err = u.db.Transaction(func(tx *gorm.DB) error {
+		if u.cfg.RequireInviteCode {
+			if err := consumeInviteCode(tx, inviteCode); err != nil {
+				return err
+			}
+		}
+		// 邮箱是否已注册交给唯一索引判断, 避免先查询再插入时并发注册同一邮箱
+		if err := tx.Create(user).Error; err != nil {
+			return duplicateUserError(err)
+		}
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
+	if user.Pending {
+		log.Printf("新用户 %s 注册, 等待管理员审核\n", user.ID.String())
+	}
 	response := user.ToResponse()
 	return &response, nil
 }
 
+// consumeInviteCode 在注册事务中使用一次邀请码, 以条件更新保证并发注册时不会超出可用次数
+func consumeInviteCode(tx *gorm.DB, code string) error {
+	now := time.Now()
+	result := tx.Model(&model.InviteCode{}).
+		Where("code = ? AND used < max_uses AND (expires_at IS NULL OR expires_at > ?)", code, now).
+		Update("used", gorm.Expr("used + ?", 1))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		return nil
+	}
+	inviteCode := model.InviteCode{}
+	if err := tx.First(&inviteCode, "code = ?", code).Error; err != nil {
+		return util.NewForbiddenOperationError("Invalid invite code")
+	}
+	if inviteCode.ExpiresAt != nil && !inviteCode.ExpiresAt.After(now) {
+		return util.NewForbiddenOperationError("Invite code expired")
+	}
+	return util.NewForbiddenOperationError("Invite code exhausted")
+}
+
+func (u *userServiceImpl) newUser(email string, password string, profileName string) (*model.User, error) {
+	hashedPass, err := bcrypt.GenerateFromPassword([]byte(password), u.cfg.BcryptCost)
+	if err != nil {
+		return nil, err
+	}
+	id := uuid.New()
+	if u.cfg.UuidStrategy == "offline" {
+		id = util.OfflineUUID(profileName)
+		// 角色改名后其他人可以使用原角色名注册, 此时由角色名计算的 UUID 会与改名的角色冲突
+		var count int64
+		if err := u.db.Table("users").Where("id = ?", id).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, util.NewForbiddenOperationError("profileName was previously used by another profile")
+		}
+	}
+	user := model.User{
+		ID:       id,
+		Email:    email,
+		Password: string(hashedPass),
+	}
+	profile, err := model.NewProfile(user.ID, profileName, model.STEVE, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := user.SetProfile(&profile); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// ensureOfflineUser 离线模式下为未注册的邮箱自动创建账号, 角色名取邮箱的用户名部分
+func (u *userServiceImpl) ensureOfflineUser(email string, password string) error {
+	var count int64
+	if err := u.db.Table("users").Where("email = ?", email).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	if u.cfg.OfflineModeSecret != "" && password != u.cfg.OfflineModeSecret {
+		return util.NewForbiddenOperationError(util.MessageInvalidCredentials)
+	}
+	profileName := strings.SplitN(email, "@", 2)[0]
+	if isInvalidProfileName(profileName) {
+		return util.NewIllegalArgumentError("bad format(profileName longer than 1)")
+	}
+	if err := u.db.Table("users").Where("profile_name = ?", profileName).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return util.NewForbiddenOperationError("profileName exist")
+	}
+	user, err := u.newUser(email, password, profileName)
+	if err != nil {
+		return err
+	}
+	if err := u.db.Create(user).Error; err != nil {
+		if isDuplicateEmail(err) {
+			// 同一邮箱并发登录, 账号已由另一个请求创建
+			return nil
+		}
+		return duplicateUserError(err)
+	}
+	log.Printf("离线模式: 已自动创建账号 %s, 角色名 %s\n", email, profileName)
+	return nil
+}
+
+// checkMojangName 检查角色名是否已被正版账号使用, 避免冒充正版玩家
+func (u *userServiceImpl) checkMojangName(profileName string) error {
+	if u.cfg.MojangNameCheck == "off" {
+		return nil
+	}
+	_, err := u.mojangClient.UsernameToUUID(profileName)
+	if err == nil {
+		return util.NewForbiddenOperationError("profileName duplicate")
+	}
+	switch err.(type) {
+	case util.YggdrasilError, *util.YggdrasilError:
+		// Mojang 正常响应, 角色名不存在
+		return nil
+	}
+	log.Printf("无法向 Mojang 查询角色名 %s: %v\n", profileName, err)
+	if u.cfg.MojangNameCheck == "deny" {
+		return util.YggdrasilError{
+			Status:       http.StatusServiceUnavailable,
+			ErrorCode:    "ForbiddenOperationException",
+			ErrorMessage: "Unable to verify profileName, please try again later",
+		}
+	}
+	return nil
+}
+
+// duplicateUserError 将创建用户时的唯一索引冲突转换为对应的错误信息
+func duplicateUserError(err error) error {
+	if !util.IsDuplicateKeyError(err) {
+		return err
+	}
+	if isDuplicateEmail(err) {
+		return util.NewForbiddenOperationError("email exist")
+	}
+	if key := util.DuplicateKey(err); key == "profile_name_idx" || key == "users.profile_name" {
+		return util.NewForbiddenOperationError("profileName exist")
+	}
+	return util.NewForbiddenOperationError("profileName was previously used by another profile")
+}
+
+// isDuplicateEmail 判断是否为邮箱唯一索引冲突 (mysql 索引名 email_idx, sqlite 列名 users.email)
+func isDuplicateEmail(err error) bool {
+	key := util.DuplicateKey(err)
+	return key == "email_idx" || key == "users.email"
+}
+
 func isInvalidProfileName(name string) bool {
 	// To support Unicode (like Chinese) profile name, abandoned treatment.
 	return name == "" || strings.ContainsRune(name, ' ') || len(name) <= 1
@@ -145,26 +475,39 @@ func isInvalidProfileName(name string) bool {
 }
 
 func (u *userServiceImpl) Login(username string, password string, clientToken *string, requestUser bool) (*LoginResponse, error) {
+	defer u.waitMinResponseTime(time.Now())
 	if !u.allowUser(username) {
-		return nil, util.YggdrasilError{
+		return nil, u.withSupportUrl(util.YggdrasilError{
 			Status:       http.StatusTooManyRequests,
 			ErrorCode:    "ForbiddenOperationException",
 			ErrorMessage: "Forbidden",
+		})
+	}
+	if u.cfg.OfflineMode {
+		if err := u.ensureOfflineUser(username, password); err != nil {
+			return nil, err
 		}
 	}
 	user := model.User{}
 	if err := u.db.Where("email = ?", username).First(&user).Error; err == nil {
 		if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil {
+			if user.Pending {
+				return nil, u.withSupportUrl(util.NewForbiddenOperationError(util.MessagePendingApproval))
+			}
+			u.upgradePasswordHash(&user, password)
 			var useClientToken string
 			if clientToken == nil || *clientToken == "" {
 				useClientToken = util.RandomUUID()
 			} else {
 				useClientToken = *clientToken
 			}
-			token := u.tokenService.AcquireToken(&user, &useClientToken, nil)
+			token, err := u.tokenService.AcquireToken(&user, &useClientToken, nil)
+			if err != nil {
+				return nil, err
+			}
 			profile, err := user.Profile()
 			if err != nil {
-				panic(err)
+				return nil, err
 			}
 			simpleResponse := profile.ToSimpleResponse()
 			var response = LoginResponse{
@@ -179,6 +522,8 @@ func (u *userServiceImpl) Login(username string, password string, clientToken *s
 			}
 			return &response, nil
 		}
+	} else {
+		_ = bcrypt.CompareHashAndPassword(u.dummyHash, []byte(password))
 	}
 
 	return nil, util.NewForbiddenOperationError(util.MessageInvalidCredentials)
@@ -204,18 +549,22 @@ func (u *userServiceImpl) ChangeProfile(accessToken string, clientToken *string,
 	}
 	if count > 0 {
 		return util.NewForbiddenOperationError("profileName exist")
-	} else if _, err := mojangUsernameToUUID(changeTo); err == nil {
-		return util.NewForbiddenOperationError("profileName duplicate")
+	} else if err := u.checkMojangName(changeTo); err != nil {
+		return err
 	}
 	if isInvalidProfileName(changeTo) {
 		return util.NewForbiddenOperationError("bad format(profileName longer than 1)")
 	}
+	if u.cfg.ReservedNames.Contains(changeTo) {
+		return util.NewForbiddenOperationError("profileName reserved")
+	}
 
 	if err = u.db.Model(&user).Update("profile_name", changeTo).Error; err != nil {
 		return err
 	}
 	profile.Name = changeTo
 	u.tokenService.UpdateProfile(user.ID, &profile)
+	u.profileCache.Invalidate(user.ID)
 	return nil
 }
 
@@ -226,6 +575,9 @@ func (u *userServiceImpl) Refresh(accessToken string, clientToken *string, reque
 			// 由于当前实现把用户 UUID 作为角色 UUID，所以不支持角色选择，只要选择了就会报错
 			return nil, util.NewForbiddenOperationError(util.MessageTokenAlreadyAssigned)
 		}
+		if u.tokenService.DetectReuse(accessToken) {
+			return nil, util.NewForbiddenOperationError(util.MessageInvalidToken)
+		}
 		if u.tokenService.VerifyToken(accessToken, clientToken) == model.Invalid {
 			return nil, util.NewForbiddenOperationError(util.MessageInvalidToken)
 		}
@@ -233,12 +585,19 @@ func (u *userServiceImpl) Refresh(accessToken string, clientToken *string, reque
 		if !ok {
 			return nil, util.NewForbiddenOperationError(util.MessageInvalidToken)
 		}
+		// 令牌中的角色缺失、已删除或数据损坏时都按无效令牌处理 (403)
+		if token.SelectedProfile.Id == uuid.Nil {
+			return nil, util.NewForbiddenOperationError(util.MessageProfileNotFound)
+		}
 
 		if err := u.db.First(&user, token.SelectedProfile.Id).Error; err != nil {
-			return nil, util.NewIllegalArgumentError(util.MessageProfileNotFound)
+			return nil, util.NewForbiddenOperationError(util.MessageProfileNotFound)
+		}
+		newToken, err := u.tokenService.RotateToken(token, &user, clientToken)
+		if err != nil {
+			log.Printf("无法刷新令牌, 角色 %s 的数据无效: %s\n", user.ID.String(), err.Error())
+			return nil, util.NewForbiddenOperationError(util.MessageProfileNotFound)
 		}
-		newToken := u.tokenService.AcquireToken(&user, clientToken, nil)
-		u.tokenService.RemoveAccessToken(accessToken)
 		simpleResponse := newToken.SelectedProfile.ToSimpleResponse()
 		var response = LoginResponse{
 			AccessToken:       newToken.AccessToken,
@@ -252,19 +611,7 @@ func (u *userServiceImpl) Refresh(accessToken string, clientToken *string, reque
 		}
 		return &response, nil
 	} else {
-		data := map[string]interface{}{
-			"accessToken":     accessToken,
-			"clientToken":     clientToken,
-			"requestUser":     requestUser,
-			"selectedProfile": selectedProfile,
-		}
-		loginResponse := LoginResponse{}
-		err := util.PostObject("https://authserver.mojang.com/refresh", data, &loginResponse)
-		if err != nil {
-			return nil, err
-		} else {
-			return &loginResponse, nil
-		}
+		return u.mojangClient.Refresh(accessToken, clientToken, requestUser, selectedProfile)
 	}
 }
 
@@ -276,16 +623,7 @@ func (u *userServiceImpl) Validate(accessToken string, clientToken *string) erro
 			return nil
 		}
 	} else {
-		data := map[string]interface{}{
-			"accessToken": accessToken,
-			"clientToken": clientToken,
-		}
-		err := util.PostObjectForError("https://authserver.mojang.com/validate", data)
-		if err != nil {
-			return err
-		} else {
-			return nil
-		}
+		return u.mojangClient.Validate(accessToken, clientToken)
 	}
 }
 
@@ -293,11 +631,7 @@ func (u *userServiceImpl) Invalidate(accessToken string) error {
 	if len(accessToken) <= 36 {
 		u.tokenService.RemoveAccessToken(accessToken)
 	} else {
-		data := map[string]interface{}{
-			"accessToken": accessToken,
-		}
-		err := util.PostObjectForError("https://authserver.mojang.com/invalidate", data)
-		if err != nil {
+		if err := u.mojangClient.Invalidate(accessToken); err != nil {
 			return err
 		}
 	}
@@ -305,33 +639,24 @@ func (u *userServiceImpl) Invalidate(accessToken string) error {
 }
 
 func (u *userServiceImpl) Signout(username string, password string) error {
+	defer u.waitMinResponseTime(time.Now())
 	if !u.allowUser(username) {
-		return util.YggdrasilError{
+		return u.withSupportUrl(util.YggdrasilError{
 			Status:       http.StatusTooManyRequests,
 			ErrorCode:    "ForbiddenOperationException",
 			ErrorMessage: "Forbidden",
-		}
+		})
 	}
 	user := model.User{}
 	if err := u.db.Where("email = ?", username).First(&user).Error; err == nil {
 		if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil {
 			u.tokenService.RemoveAll(user.ID)
 			return nil
-		} else {
-			return util.NewForbiddenOperationError(util.MessageInvalidCredentials)
 		}
 	} else {
-		data := map[string]interface{}{
-			"username": username,
-			"password": password,
-		}
-		err := util.PostObjectForError("https://authserver.mojang.com/signout", data)
-		if err != nil {
-			return err
-		} else {
-			return nil
-		}
+		_ = bcrypt.CompareHashAndPassword(u.dummyHash, []byte(password))
 	}
+	return util.NewForbiddenOperationError(util.MessageInvalidCredentials)
 }
 
 func (u *userServiceImpl) UsernameToUUID(username string) (*model.ProfileResponse, error) {
@@ -342,7 +667,7 @@ func (u *userServiceImpl) UsernameToUUID(username string) (*model.ProfileRespons
 			Id:   util.UnsignedString(user.ID),
 		}, nil
 	} else {
-		response, err := mojangUsernameToUUID(username)
+		response, err := u.mojangClient.UsernameToUUID(username)
 		if err != nil {
 			return nil, nil
 		} else {
@@ -352,6 +677,21 @@ func (u *userServiceImpl) UsernameToUUID(username string) (*model.ProfileRespons
 }
 
 func (u *userServiceImpl) QueryUUIDs(usernames []string) ([]model.ProfileResponse, error) {
+	results, err := u.QueryUUIDsDetailed(usernames)
+	if err != nil {
+		return nil, err
+	}
+	responses := make([]model.ProfileResponse, 0, len(results))
+	for _, result := range results {
+		if result.Status == LookupFound {
+			responses = append(responses, result.Profile.(model.ProfileResponse))
+		}
+	}
+	return responses, nil
+}
+
+// QueryUUIDsDetailed 批量查询角色 UUID, 最多查询前 10 个角色名, 本地不存在的转发到 Mojang, 逐个返回查询结果
+func (u *userServiceImpl) QueryUUIDsDetailed(usernames []string) ([]BulkLookupResult, error) {
 	var users []model.User
 	var names []string
 	if len(usernames) > 10 {
@@ -359,40 +699,184 @@ func (u *userServiceImpl) QueryUUIDs(usernames []string) ([]model.ProfileRespons
 	} else {
 		names = usernames
 	}
-	var responses = make([]model.ProfileResponse, 0)
+	found := make(map[string]model.ProfileResponse)
 	if err := u.db.Table("users").Where("profile_name in ?", names).Find(&users).Error; err == nil {
 		for _, user := range users {
-			responses = append(responses, model.ProfileResponse{
+			found[strings.ToLower(user.ProfileName)] = model.ProfileResponse{
 				Name: user.ProfileName,
 				Id:   util.UnsignedString(user.ID),
-			})
+			}
+		}
+	}
+	notFoundUsers := make([]string, 0, len(names))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		lowerName := strings.ToLower(name)
+		if _, ok := found[lowerName]; !ok && !seen[lowerName] {
+			seen[lowerName] = true
+			notFoundUsers = append(notFoundUsers, name)
+		}
+	}
+	var failed map[string]error
+	if len(notFoundUsers) > 0 {
+		// 部分批次失败时仍返回已查询到的角色
+		var mojangResponses []model.ProfileResponse
+		mojangResponses, failed = u.mojangClient.UsernamesToUUIDs(notFoundUsers)
+		for _, response := range mojangResponses {
+			if lowerName := strings.ToLower(response.Name); seen[lowerName] {
+				found[lowerName] = response
+			}
+		}
+	}
+	results := make([]BulkLookupResult, 0, len(names))
+	reported := make(map[string]bool)
+	for _, name := range names {
+		lowerName := strings.ToLower(name)
+		if reported[lowerName] {
+			continue
+		}
+		reported[lowerName] = true
+		if response, ok := found[lowerName]; ok {
+			results = append(results, BulkLookupResult{Name: name, Status: LookupFound, Profile: response})
+		} else if _, ok := failed[name]; ok {
+			// 详细错误已记录在日志中, 不向客户端暴露上游网络信息
+			results = append(results, BulkLookupResult{Name: name, Status: LookupError, Error: "Mojang lookup failed"})
+		} else {
+			results = append(results, BulkLookupResult{Name: name, Status: LookupNotFound})
+		}
+	}
+	return results, nil
+}
+
+// QueryProfiles 批量查询角色的完整信息(含材质), 去重后最多查询 MaxBulkProfileLookup 个角色名, 未找到的角色名会被忽略;
+// 开启 UpstreamProfileLookup 时本地不存在的角色名会转发到 Mojang 查询
+func (u *userServiceImpl) QueryProfiles(usernames []string, unsigned bool, textureBaseUrl string) ([]map[string]interface{}, error) {
+	results, err := u.QueryProfilesDetailed(usernames, unsigned, textureBaseUrl)
+	if err != nil {
+		return nil, err
+	}
+	responses := make([]map[string]interface{}, 0, len(results))
+	for _, result := range results {
+		if result.Status == LookupFound || result.Status == LookupUpstream {
+			responses = append(responses, result.Profile.(map[string]interface{}))
 		}
 	}
 	return responses, nil
 }
 
+// QueryProfilesDetailed 与 QueryProfiles 相同, 但逐个返回每个角色名的查询结果
+func (u *userServiceImpl) QueryProfilesDetailed(usernames []string, unsigned bool, textureBaseUrl string) ([]BulkLookupResult, error) {
+	names := make([]string, 0, len(usernames))
+	seen := make(map[string]bool)
+	for _, name := range usernames {
+		if lowerName := strings.ToLower(name); !seen[lowerName] {
+			seen[lowerName] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) > MaxBulkProfileLookup {
+		return nil, util.NewIllegalArgumentError(fmt.Sprintf("Too many names (max %d)", MaxBulkProfileLookup))
+	}
+	results := make([]BulkLookupResult, 0, len(names))
+	if len(names) == 0 {
+		return results, nil
+	}
+	var users []model.User
+	if err := u.db.Where("profile_name in ?", names).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	found := make(map[string]map[string]interface{})
+	failed := make(map[string]bool)
+	for _, user := range users {
+		lowerName := strings.ToLower(user.ProfileName)
+		profile, err := user.Profile()
+		if err == nil {
+			var response map[string]interface{}
+			if response, err = profile.ToCompleteResponse(!unsigned, textureBaseUrl, u.textureCfg.UploadableTextures, u.textureCfg.HdSkins); err == nil {
+				found[lowerName] = response
+				continue
+			}
+		}
+		// 单个角色数据损坏时不影响同批次的其他角色
+		log.Printf("无法生成角色 %s 的信息: %s\n", user.ID.String(), err.Error())
+		failed[lowerName] = true
+	}
+	upstream := make(map[string]map[string]interface{})
+	if u.cfg.UpstreamProfileLookup {
+		notFound := make([]string, 0, len(names))
+		for _, name := range names {
+			if lowerName := strings.ToLower(name); found[lowerName] == nil && !failed[lowerName] {
+				notFound = append(notFound, name)
+			}
+		}
+		if len(notFound) > 0 {
+			upstream = u.queryUpstreamProfiles(notFound, unsigned, failed)
+		}
+	}
+	for _, name := range names {
+		lowerName := strings.ToLower(name)
+		if response, ok := found[lowerName]; ok {
+			results = append(results, BulkLookupResult{Name: name, Status: LookupFound, Profile: response})
+		} else if response, ok := upstream[lowerName]; ok {
+			results = append(results, BulkLookupResult{Name: name, Status: LookupUpstream, Profile: response})
+		} else if failed[lowerName] {
+			results = append(results, BulkLookupResult{Name: name, Status: LookupError, Error: "Profile lookup failed"})
+		} else {
+			results = append(results, BulkLookupResult{Name: name, Status: LookupNotFound})
+		}
+	}
+	return results, nil
+}
+
+// queryUpstreamProfiles 从 Mojang 查询本地不存在的角色的完整信息, 查询出错的角色名记入 failed
+func (u *userServiceImpl) queryUpstreamProfiles(names []string, unsigned bool, failed map[string]bool) map[string]map[string]interface{} {
+	upstream := make(map[string]map[string]interface{})
+	responses, errs := u.mojangClient.UsernamesToUUIDs(names)
+	for name := range errs {
+		failed[strings.ToLower(name)] = true
+	}
+	for _, response := range responses {
+		lowerName := strings.ToLower(response.Name)
+		profileId, err := util.ToUUID(response.Id)
+		if err != nil {
+			failed[lowerName] = true
+			continue
+		}
+		result, err := u.mojangClient.QueryProfile(profileId, unsigned)
+		if err != nil {
+			log.Printf("无法从 Mojang 查询角色 %s: %s\n", response.Name, err.Error())
+			failed[lowerName] = true
+			continue
+		}
+		upstream[lowerName] = model.SanitizeProfileResponse(result)
+	}
+	return upstream
+}
+
 func (u *userServiceImpl) QueryProfile(profileId uuid.UUID, unsigned bool, textureBaseUrl string) (map[string]interface{}, error) {
+	if response, ok := u.profileCache.Get(profileId, unsigned, textureBaseUrl); ok {
+		return response, nil
+	}
 	user := model.User{}
+	var response map[string]interface{}
 	if err := u.db.First(&user, profileId).Error; err == nil {
 		profile, err := user.Profile()
 		if err != nil {
 			return nil, err
 		}
-		response, err := profile.ToCompleteResponse(!unsigned, textureBaseUrl)
+		response, err = profile.ToCompleteResponse(!unsigned, textureBaseUrl, u.textureCfg.UploadableTextures, u.textureCfg.HdSkins)
 		if err != nil {
 			return nil, err
-		} else {
-			return response, err
 		}
 	} else {
-		result := map[string]interface{}{}
-		err := util.GetObject(fmt.Sprintf("https://sessionserver.mojang.com/session/minecraft/profile/%s?unsigned=%t", util.UnsignedString(profileId), unsigned), &result)
+		result, err := u.mojangClient.QueryProfile(profileId, unsigned)
 		if err != nil {
 			return nil, err
-		} else {
-			return result, nil
 		}
+		response = model.SanitizeProfileResponse(result)
 	}
+	u.profileCache.Add(profileId, unsigned, textureBaseUrl, response)
+	return response, nil
 }
 
 func (u *userServiceImpl) ProfileKey(accessToken string) (resp *ProfileKeyResponse, err error) {
@@ -415,7 +899,7 @@ func (u *userServiceImpl) ProfileKey(accessToken string) (resp *ProfileKeyRespon
 		resp.PublicKeySignature = sign
 		resp.PublicKeySignatureV2 = sign
 	} else {
-		err = util.PostForString("https://api.minecraftservices.com/player/certificates", accessToken, []byte(""), resp)
+		resp, err = u.mojangClient.ProfileKey(accessToken)
 		if err != nil {
 			return nil, err
 		}
@@ -423,18 +907,169 @@ func (u *userServiceImpl) ProfileKey(accessToken string) (resp *ProfileKeyRespon
 	return resp, nil
 }
 
-func (u *userServiceImpl) allowUser(username string) bool {
-	if value, ok := u.limitLruCache.Get(username); ok {
-		if limiter, ok := value.(*rate.Limiter); ok {
-			return limiter.Allow()
-		} else {
-			u.limitLruCache.Remove(username)
+// RevokeProfileKey 丢弃角色当前的证书密钥对, 下次请求时将签发新的密钥对
+func (u *userServiceImpl) RevokeProfileKey(accessToken string) error {
+	token, ok := u.tokenService.GetToken(accessToken)
+	if !ok || token.GetAvailableLevel() != model.Valid {
+		return util.NewForbiddenOperationError(util.MessageInvalidToken)
+	}
+	profileId := token.SelectedProfile.Id
+	u.profileKeyCache.Remove(profileId)
+	log.Printf("审计: 角色 %s 重置了证书密钥对\n", util.UnsignedString(profileId))
+	return nil
+}
+
+func (u *userServiceImpl) TokenInfo(accessToken string) (*TokenInfoResponse, error) {
+	token, ok := u.tokenService.GetToken(accessToken)
+	if !ok {
+		return nil, util.NewForbiddenOperationError(util.MessageInvalidToken)
+	}
+	now := time.Now()
+	refreshAt := token.RefreshAt()
+	expiresAt := token.ExpiresAt()
+	response := TokenInfoResponse{
+		AvailableLevel: token.GetAvailableLevel().String(),
+		RefreshAt:      refreshAt.UTC(),
+		ExpiresAt:      expiresAt.UTC(),
+	}
+	if d := refreshAt.Sub(now); d > 0 {
+		response.RefreshIn = int64(d / time.Second)
+	}
+	if d := expiresAt.Sub(now); d > 0 {
+		response.ExpiresIn = int64(d / time.Second)
+	}
+	return &response, nil
+}
+
+// ExportProfile 导出当前用户的角色信息(与 Mojang 角色接口格式相同, 材质已签名)及账号信息, 用于迁移到其他服务器
+func (u *userServiceImpl) ExportProfile(accessToken string, textureBaseUrl string) (*ExportResponse, error) {
+	if u.tokenService.VerifyToken(accessToken, nil) != model.Valid {
+		return nil, util.NewForbiddenOperationError(util.MessageInvalidToken)
+	}
+	token, ok := u.tokenService.GetToken(accessToken)
+	if !ok {
+		return nil, util.NewForbiddenOperationError(util.MessageInvalidToken)
+	}
+	user := model.User{}
+	if err := u.db.First(&user, token.SelectedProfile.Id).Error; err != nil {
+		return nil, util.NewForbiddenOperationError(util.MessageProfileNotFound)
+	}
+	profile, err := user.Profile()
+	if err != nil {
+		return nil, err
+	}
+	profileResponse, err := profile.ToCompleteResponse(true, textureBaseUrl, u.textureCfg.UploadableTextures, u.textureCfg.HdSkins)
+	if err != nil {
+		return nil, err
+	}
+	return &ExportResponse{
+		Email:     user.Email,
+		CreatedAt: user.CreatedAt.UTC(),
+		Profile:   profileResponse,
+	}, nil
+}
+
+func (u *userServiceImpl) PlayerAttributes(accessToken string) (*PlayerAttributesResponse, error) {
+	if u.tokenService.VerifyToken(accessToken, nil) != model.Valid {
+		return nil, util.NewForbiddenOperationError(util.MessageInvalidToken)
+	}
+	token, ok := u.tokenService.GetToken(accessToken)
+	if !ok {
+		return nil, util.NewForbiddenOperationError(util.MessageInvalidToken)
+	}
+	privileges := u.cfg.Privileges
+	if token.SelectedProfile.Id != uuid.Nil {
+		user := model.User{}
+		if err := u.db.First(&user, token.SelectedProfile.Id).Error; err != nil {
+			return nil, util.NewForbiddenOperationError(util.MessageProfileNotFound)
 		}
-	} else {
-		limiter := rate.NewLimiter(0.2, 3)
-		u.limitLruCache.Add(username, limiter)
+		privileges = privileges.withOverrides(&user)
+	}
+	response := privileges.toResponse()
+	return &response, nil
+}
+
+func (u *userServiceImpl) BlockList(accessToken string) (*BlockListResponse, error) {
+	blockerId, err := u.selectedProfileId(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	var blocks []model.Block
+	if err := u.db.Where("blocker_id = ?", blockerId).Order("created_at").Find(&blocks).Error; err != nil {
+		return nil, err
+	}
+	response := BlockListResponse{BlockedProfiles: make([]string, 0, len(blocks))}
+	for _, block := range blocks {
+		response.BlockedProfiles = append(response.BlockedProfiles, util.UnsignedString(block.BlockedID))
+	}
+	return &response, nil
+}
+
+func (u *userServiceImpl) BlockPlayer(accessToken string, blockedId uuid.UUID) error {
+	blockerId, err := u.selectedProfileId(accessToken)
+	if err != nil {
+		return err
+	}
+	if blockerId == blockedId {
+		return util.NewIllegalArgumentError("cannot block yourself")
+	}
+	if err := u.db.Select("id").First(&model.User{}, blockedId).Error; err != nil {
+		return util.NewIllegalArgumentError(util.MessageProfileNotFound)
+	}
+	block := model.Block{BlockerID: blockerId, BlockedID: blockedId}
+	return u.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&block).Error
+}
+
+func (u *userServiceImpl) UnblockPlayer(accessToken string, blockedId uuid.UUID) error {
+	blockerId, err := u.selectedProfileId(accessToken)
+	if err != nil {
+		return err
+	}
+	return u.db.Where("blocker_id = ? AND blocked_id = ?", blockerId, blockedId).Delete(&model.Block{}).Error
+}
+
+// selectedProfileId 获取有效令牌绑定的角色
+func (u *userServiceImpl) selectedProfileId(accessToken string) (uuid.UUID, error) {
+	token, ok := u.tokenService.GetToken(accessToken)
+	if !ok || token.GetAvailableLevel() != model.Valid {
+		return uuid.Nil, util.NewForbiddenOperationError(util.MessageInvalidToken)
+	}
+	if token.SelectedProfile.Id == uuid.Nil {
+		return uuid.Nil, util.NewForbiddenOperationError(util.MessageProfileNotFound)
+	}
+	return token.SelectedProfile.Id, nil
+}
+
+func (u *userServiceImpl) allowUser(username string) bool {
+	return u.userLimiter.Allow(username)
+}
+
+// upgradePasswordHash 密码哈希强度低于配置值时使用当前配置重新哈希
+func (u *userServiceImpl) upgradePasswordHash(user *model.User, password string) {
+	if cost, err := bcrypt.Cost([]byte(user.Password)); err != nil || cost >= u.cfg.BcryptCost {
+		return
+	}
+	hashedPass, err := bcrypt.GenerateFromPassword([]byte(password), u.cfg.BcryptCost)
+	if err != nil {
+		log.Printf("无法重新哈希用户 %s 的密码: %s\n", user.ID.String(), err.Error())
+		return
+	}
+	if err := u.db.Model(user).Update("password", string(hashedPass)).Error; err != nil {
+		log.Printf("无法更新用户 %s 的密码哈希: %s\n", user.ID.String(), err.Error())
+	}
+}
+
+func (u *userServiceImpl) withSupportUrl(err util.YggdrasilError) util.YggdrasilError {
+	if len(u.cfg.SupportUrl) > 0 {
+		err.Cause = "Contact: " + u.cfg.SupportUrl
+	}
+	return err
+}
+
+func (u *userServiceImpl) waitMinResponseTime(start time.Time) {
+	if remaining := u.cfg.AuthMinResponseTime - time.Since(start); remaining > 0 {
+		time.Sleep(remaining)
 	}
-	return true
 }
 
 func (u *userServiceImpl) getProfileKey(profileId uuid.UUID) (*ProfileKeyPair, error) {
@@ -443,51 +1078,67 @@ func (u *userServiceImpl) getProfileKey(profileId uuid.UUID) (*ProfileKeyPair, e
 			return keyPair, nil
 		}
 	}
-	if keyPair, ok := <-u.keyPairCh; ok {
-		u.profileKeyCache.Add(profileId, &keyPair)
-		return &keyPair, nil
-	} else {
-		return nil, errors.New("unable to generate rsa key pair")
+	keyPair := <-u.keyPairCh
+	if remaining := len(u.keyPairCh); remaining < u.cfg.ProfileKeyLowWater || remaining == 0 {
+		// 唤醒一个已暂停的生成协程, 不阻塞请求
+		select {
+		case u.keyPairRefill <- struct{}{}:
+		default:
+		}
 	}
+	u.profileKeyCache.Add(profileId, &keyPair)
+	return &keyPair, nil
 }
 
+// genKeyPair 持续向密钥对池补充密钥对, 达到高水位后暂停, 直到池中数量低于低水位
 func (u *userServiceImpl) genKeyPair() {
 	for {
-		keyPair := ProfileKeyPair{}
-		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-		if err != nil {
-			close(u.keyPairCh)
-			panic(err)
+		for u.cfg.ProfileKeyHighWater > 0 && len(u.keyPairCh) >= u.cfg.ProfileKeyHighWater {
+			<-u.keyPairRefill
 		}
-		privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
-		if err != nil {
-			close(u.keyPairCh)
-			panic(err)
-		}
-		keyPair.PrivateKey = string(pem.EncodeToMemory(&pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: privateKeyBytes,
-		}))
-		publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+		if u.cfg.ProfileKeyGenInterval > 0 {
+			time.Sleep(u.cfg.ProfileKeyGenInterval)
+		}
+		keyPair, err := u.generateKeyPair()
 		if err != nil {
-			close(u.keyPairCh)
-			panic(err)
+			log.Printf("无法生成 RSA 密钥对, %s 后重试: %s\n", u.keyPairRetryDelay, err.Error())
+			time.Sleep(u.keyPairRetryDelay)
+			continue
 		}
-		keyPair.PublicKey = string(pem.EncodeToMemory(&pem.Block{
-			Type:  "RSA PUBLIC KEY",
-			Bytes: publicKeyBytes,
-		}))
 		u.keyPairCh <- keyPair
 	}
 }
 
-func mojangUsernameToUUID(username string) (model.ProfileResponse, error) {
-	response := model.ProfileResponse{}
-	reqUrl := fmt.Sprintf("https://api.mojang.com/users/profiles/minecraft/%s", url.PathEscape(username))
-	err := util.GetObject(reqUrl, &response)
+// generateKeyPair 调用 keyPairGenerator, 并将其中的 panic 转换为错误, 避免生成协程退出
+func (u *userServiceImpl) generateKeyPair() (keyPair ProfileKeyPair, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return u.keyPairGenerator()
+}
+
+func newProfileKeyPair() (keyPair ProfileKeyPair, err error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		return response, err
-	} else {
-		return response, nil
+		return keyPair, err
+	}
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return keyPair, err
+	}
+	keyPair.PrivateKey = string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: privateKeyBytes,
+	}))
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return keyPair, err
 	}
+	keyPair.PublicKey = string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PUBLIC KEY",
+		Bytes: publicKeyBytes,
+	}))
+	return keyPair, nil
 }
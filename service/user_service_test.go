@@ -0,0 +1,937 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"yggdrasil-go/model"
+	"yggdrasil-go/util"
+)
+
+// fakeMojangClient 模拟 Mojang 接口, taken 中的角色名视为已被正版玩家使用, err 不为 nil 时模拟网络错误
+type fakeMojangClient struct {
+	taken map[string]string
+	err   error
+}
+
+func (f *fakeMojangClient) UsernameToUUID(username string) (model.ProfileResponse, error) {
+	if f.err != nil {
+		return model.ProfileResponse{}, f.err
+	}
+	if id, ok := f.taken[strings.ToLower(username)]; ok {
+		return model.ProfileResponse{Name: username, Id: id}, nil
+	}
+	return model.ProfileResponse{}, util.YggdrasilError{Status: http.StatusNotFound, ErrorCode: "Not Found"}
+}
+
+func (f *fakeMojangClient) UsernamesToUUIDs(usernames []string) ([]model.ProfileResponse, map[string]error) {
+	responses := make([]model.ProfileResponse, 0, len(usernames))
+	errs := make(map[string]error)
+	for _, username := range usernames {
+		if f.err != nil {
+			errs[username] = f.err
+		} else if id, ok := f.taken[strings.ToLower(username)]; ok {
+			responses = append(responses, model.ProfileResponse{Name: username, Id: id})
+		}
+	}
+	return responses, errs
+}
+
+func (f *fakeMojangClient) QueryProfile(profileId uuid.UUID, _ bool) (map[string]interface{}, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	for name, id := range f.taken {
+		if id == util.UnsignedString(profileId) {
+			return map[string]interface{}{"id": id, "name": name, "properties": []interface{}{}, "legacy": true}, nil
+		}
+	}
+	return nil, util.YggdrasilError{Status: http.StatusNoContent}
+}
+
+func (f *fakeMojangClient) Refresh(string, *string, bool, *model.ProfileResponse) (*LoginResponse, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *fakeMojangClient) Validate(string, *string) error {
+	return errors.New("not implemented")
+}
+
+func (f *fakeMojangClient) Invalidate(string) error {
+	return errors.New("not implemented")
+}
+
+func (f *fakeMojangClient) ProfileKey(string) (*ProfileKeyResponse, error) {
+	return nil, errors.New("not implemented")
+}
+
+// newTestDB 为每个测试创建独立的内存 sqlite 数据库
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := "file:" + strings.ReplaceAll(t.Name(), "/", "_") + "?mode=memory&cache=shared"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 内存数据库在最后一个连接关闭时销毁, 单个连接同时避免 sqlite 的并发写锁冲突
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = sqlDB.Close() })
+	err = db.AutoMigrate(&model.User{}, &model.Texture{}, &model.UserTexture{}, &model.Block{}, &model.InviteCode{}, &model.TextureHistory{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func newTestUserService(t *testing.T, db *gorm.DB, mojangClient MojangClient) *userServiceImpl {
+	t.Helper()
+	cacheCfg := DefaultCacheCfg()
+	tokenService := NewTokenService(TokenCfg{
+		ValidDuration:   model.DefaultTokenValidDuration,
+		RefreshDuration: model.DefaultTokenRefreshDuration,
+	}, cacheCfg)
+	cfg := UserCfg{
+		RegistrationOpen:     true,
+		BcryptCost:           bcrypt.MinCost,
+		UuidStrategy:         "random",
+		MojangNameCheck:      "allow",
+		ProfileKeyGenerators: 0,
+	}
+	return NewUserService(tokenService, mojangClient, NewProfileCache(cacheCfg), db, cfg, RateLimitCfg{}, TextureCfg{}, cacheCfg).(*userServiceImpl)
+}
+
+// createTestUser 直接写入数据库创建用户, 并为其签发令牌
+func createTestUser(t *testing.T, u *userServiceImpl, email string, profileName string) (*model.User, *model.Token) {
+	t.Helper()
+	user, err := u.newUser(email, "password", profileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	token, err := u.tokenService.AcquireToken(user, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token
+}
+
+// errorMessage 返回错误信息, YggdrasilError 的 Error() 即为其 ErrorMessage
+func errorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func TestChangeProfile(t *testing.T) {
+	tests := []struct {
+		name     string
+		changeTo string
+		taken    map[string]string
+		wantErr  string
+	}{
+		{name: "success", changeTo: "NewName"},
+		{name: "local collision", changeTo: "Other", wantErr: "profileName exist"},
+		{name: "mojang duplicate", changeTo: "Notch", taken: map[string]string{"notch": "069a79f444e94726a5befca90e38aaf5"}, wantErr: "profileName duplicate"},
+		{name: "invalid format", changeTo: "bad name", wantErr: "bad format(profileName longer than 1)"},
+		{name: "too short", changeTo: "x", wantErr: "bad format(profileName longer than 1)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newTestUserService(t, newTestDB(t), &fakeMojangClient{taken: tt.taken})
+			user, token := createTestUser(t, u, "tester@example.com", "Tester")
+			createTestUser(t, u, "other@example.com", "Other")
+
+			err := u.ChangeProfile(token.AccessToken, nil, tt.changeTo)
+			if got := errorMessage(err); got != tt.wantErr {
+				t.Fatalf("ChangeProfile() error = %q, want %q", got, tt.wantErr)
+			}
+			stored := model.User{}
+			if err := u.db.First(&stored, user.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+			wantName := "Tester"
+			if tt.wantErr == "" {
+				wantName = tt.changeTo
+			}
+			if stored.ProfileName != wantName {
+				t.Errorf("stored profile name = %q, want %q", stored.ProfileName, wantName)
+			}
+			if updated, _ := u.tokenService.GetToken(token.AccessToken); updated.SelectedProfile.Name != wantName {
+				t.Errorf("token profile name = %q, want %q", updated.SelectedProfile.Name, wantName)
+			}
+		})
+	}
+}
+
+const keyPairTimeout = 30 * time.Second
+
+func newKeyPoolService(t *testing.T, cfg UserCfg) *userServiceImpl {
+	t.Helper()
+	if err := cfg.ResolveKeyPoolWaterMarks(); err != nil {
+		t.Fatal(err)
+	}
+	cache, _ := lru.New(16)
+	return &userServiceImpl{
+		cfg:               cfg,
+		profileKeyCache:   cache,
+		keyPairCh:         make(chan ProfileKeyPair, cfg.ProfileKeyPoolSize),
+		keyPairRefill:     make(chan struct{}, 1),
+		keyPairGenerator:  newProfileKeyPair,
+		keyPairRetryDelay: time.Second,
+	}
+}
+
+func waitForPoolSize(t *testing.T, u *userServiceImpl, size int) {
+	t.Helper()
+	deadline := time.Now().Add(keyPairTimeout)
+	for len(u.keyPairCh) < size {
+		if time.Now().After(deadline) {
+			t.Fatalf("key pair pool did not reach %d, got %d", size, len(u.keyPairCh))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func takeProfileKey(t *testing.T, u *userServiceImpl) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		_, _ = u.getProfileKey(uuid.New())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(keyPairTimeout):
+		t.Fatal("getProfileKey blocked, generators were not woken up")
+	}
+}
+
+func TestResolveKeyPoolWaterMarks(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      UserCfg
+		wantHigh int
+		wantLow  int
+		wantErr  bool
+	}{
+		{name: "defaults", cfg: UserCfg{ProfileKeyPoolSize: 100}, wantHigh: 100, wantLow: 50},
+		{name: "pool size 1", cfg: UserCfg{ProfileKeyPoolSize: 1}, wantHigh: 1, wantLow: 1},
+		{name: "high water 1", cfg: UserCfg{ProfileKeyPoolSize: 10, ProfileKeyHighWater: 1}, wantHigh: 1, wantLow: 1},
+		{name: "pool size 0", cfg: UserCfg{ProfileKeyPoolSize: 0}, wantHigh: 0, wantLow: 0},
+		{name: "high above pool", cfg: UserCfg{ProfileKeyPoolSize: 10, ProfileKeyHighWater: 11}, wantErr: true},
+		{name: "low above high", cfg: UserCfg{ProfileKeyPoolSize: 10, ProfileKeyHighWater: 5, ProfileKeyLowWater: 6}, wantErr: true},
+		{name: "negative low", cfg: UserCfg{ProfileKeyPoolSize: 10, ProfileKeyLowWater: -1}, wantErr: true},
+		{name: "negative interval", cfg: UserCfg{ProfileKeyPoolSize: 10, ProfileKeyGenInterval: -time.Second}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			err := cfg.ResolveKeyPoolWaterMarks()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveKeyPoolWaterMarks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (cfg.ProfileKeyHighWater != tt.wantHigh || cfg.ProfileKeyLowWater != tt.wantLow) {
+				t.Errorf("water marks = %d/%d, want %d/%d", cfg.ProfileKeyHighWater, cfg.ProfileKeyLowWater, tt.wantHigh, tt.wantLow)
+			}
+		})
+	}
+}
+
+func TestGenKeyPairBacksOffWhenFull(t *testing.T) {
+	u := newKeyPoolService(t, UserCfg{ProfileKeyPoolSize: 4})
+	go u.genKeyPair()
+	waitForPoolSize(t, u, 4)
+
+	// 取走一个后仍不低于低水位 (2), 生成协程应保持暂停
+	takeProfileKey(t, u)
+	time.Sleep(time.Second)
+	if got := len(u.keyPairCh); got != 3 {
+		t.Fatalf("pool refilled above low water, got %d, want 3", got)
+	}
+
+	// 低于低水位后恢复生成, 直到再次填满
+	takeProfileKey(t, u)
+	takeProfileKey(t, u)
+	waitForPoolSize(t, u, 4)
+}
+
+func TestGenKeyPairPoolSizeOne(t *testing.T) {
+	u := newKeyPoolService(t, UserCfg{ProfileKeyPoolSize: 1})
+	go u.genKeyPair()
+	for i := 0; i < 3; i++ {
+		takeProfileKey(t, u)
+	}
+}
+
+func TestGenKeyPairRecoversFromGeneratorFailures(t *testing.T) {
+	u := newKeyPoolService(t, UserCfg{ProfileKeyPoolSize: 2})
+	u.keyPairRetryDelay = time.Millisecond
+	var calls int32
+	u.keyPairGenerator = func() (ProfileKeyPair, error) {
+		// 每生成一个密钥对之前依次 panic 和返回错误
+		switch n := atomic.AddInt32(&calls, 1); n % 3 {
+		case 1:
+			panic("entropy source exhausted")
+		case 2:
+			return ProfileKeyPair{}, errors.New("generator failed")
+		default:
+			return ProfileKeyPair{PublicKey: fmt.Sprintf("key-%d", n/3)}, nil
+		}
+	}
+	go u.genKeyPair()
+
+	for i := 1; i <= 4; i++ {
+		done := make(chan *ProfileKeyPair, 1)
+		go func() {
+			keyPair, _ := u.getProfileKey(uuid.New())
+			done <- keyPair
+		}()
+		select {
+		case keyPair := <-done:
+			if want := fmt.Sprintf("key-%d", i); keyPair.PublicKey != want {
+				t.Errorf("key pair %d = %q, want %q", i, keyPair.PublicKey, want)
+			}
+		case <-time.After(keyPairTimeout):
+			t.Fatalf("generator stopped serving after %d failures", atomic.LoadInt32(&calls))
+		}
+	}
+}
+
+// countingMojangClient 记录按角色名查询 Mojang 的次数
+type countingMojangClient struct {
+	*fakeMojangClient
+	lookups int32
+}
+
+func (c *countingMojangClient) UsernameToUUID(username string) (model.ProfileResponse, error) {
+	atomic.AddInt32(&c.lookups, 1)
+	return c.fakeMojangClient.UsernameToUUID(username)
+}
+
+func TestCheckMojangNameUnavailable(t *testing.T) {
+	tests := []struct {
+		mode        string
+		wantStatus  int
+		wantLookups int32
+	}{
+		{"off", 0, 0},
+		{"allow", 0, 1},
+		{"deny", http.StatusServiceUnavailable, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			// Mojang 不可用时: off 不查询, allow 放行, deny 返回 503
+			check := func(t *testing.T, name string, err error, lookups int32) {
+				t.Helper()
+				if tt.wantStatus == 0 {
+					if err != nil {
+						t.Fatalf("%s error = %v, want nil", name, err)
+					}
+				} else {
+					var yggError util.YggdrasilError
+					if !errors.As(err, &yggError) || yggError.Status != tt.wantStatus {
+						t.Fatalf("%s error = %#v, want status %d", name, err, tt.wantStatus)
+					}
+				}
+				if lookups != tt.wantLookups {
+					t.Errorf("%s queried Mojang %d times, want %d", name, lookups, tt.wantLookups)
+				}
+			}
+			mojang := &countingMojangClient{fakeMojangClient: &fakeMojangClient{err: errors.New("connection refused")}}
+			u := newTestUserService(t, newTestDB(t), mojang)
+			u.cfg.MojangNameCheck = tt.mode
+			SetRegistrationOpen(true)
+
+			_, err := u.Register("new@example.com", "password", "NewPlayer", "", "192.0.2.1")
+			check(t, "Register()", err, atomic.SwapInt32(&mojang.lookups, 0))
+
+			_, token := createTestUser(t, u, "tester@example.com", "Tester")
+			err = u.ChangeProfile(token.AccessToken, nil, "Renamed")
+			check(t, "ChangeProfile()", err, atomic.SwapInt32(&mojang.lookups, 0))
+		})
+	}
+}
+
+func TestUsernameToUUIDFallback(t *testing.T) {
+	mojangClient := &fakeMojangClient{taken: map[string]string{"notch": "069a79f444e94726a5befca90e38aaf5"}}
+	u := newTestUserService(t, newTestDB(t), mojangClient)
+	user, _ := createTestUser(t, u, "tester@example.com", "Tester")
+
+	// 本地角色优先
+	response, err := u.UsernameToUUID("Tester")
+	if err != nil || response == nil || response.Id != util.UnsignedString(user.ID) {
+		t.Fatalf("UsernameToUUID(Tester) = %v, %v, want local profile %s", response, err, util.UnsignedString(user.ID))
+	}
+	// 本地不存在时回退到 Mojang
+	response, err = u.UsernameToUUID("Notch")
+	if err != nil || response == nil || response.Id != "069a79f444e94726a5befca90e38aaf5" {
+		t.Fatalf("UsernameToUUID(Notch) = %v, %v, want Mojang profile", response, err)
+	}
+	// 两边都不存在
+	response, err = u.UsernameToUUID("Nobody")
+	if err != nil || response != nil {
+		t.Fatalf("UsernameToUUID(Nobody) = %v, %v, want nil, nil", response, err)
+	}
+	// Mojang 网络错误时视为未找到
+	mojangClient.err = errors.New("connection refused")
+	response, err = u.UsernameToUUID("Notch")
+	if err != nil || response != nil {
+		t.Fatalf("UsernameToUUID(Notch) with upstream error = %v, %v, want nil, nil", response, err)
+	}
+}
+
+func TestQueryUUIDsDetailed(t *testing.T) {
+	mojangClient := &fakeMojangClient{taken: map[string]string{"notch": "069a79f444e94726a5befca90e38aaf5"}}
+	u := newTestUserService(t, newTestDB(t), mojangClient)
+	createTestUser(t, u, "tester@example.com", "Tester")
+
+	results, err := u.QueryUUIDsDetailed([]string{"Tester", "Notch", "Nobody", "tester"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"Tester": LookupFound, "Notch": LookupFound, "Nobody": LookupNotFound}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d (duplicates should be dropped): %+v", len(results), len(want), results)
+	}
+	for _, result := range results {
+		if result.Status != want[result.Name] {
+			t.Errorf("%s: status = %q, want %q", result.Name, result.Status, want[result.Name])
+		}
+	}
+
+	responses, err := u.QueryUUIDs([]string{"Tester", "Notch", "Nobody"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 2 {
+		t.Errorf("QueryUUIDs returned %d profiles, want 2: %+v", len(responses), responses)
+	}
+
+	mojangClient.err = errors.New("connection refused")
+	results, err = u.QueryUUIDsDetailed([]string{"Tester", "Notch"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Status != LookupFound || results[1].Status != LookupError {
+		t.Errorf("with upstream error got %+v, want local found and Mojang error", results)
+	}
+	if results[1].Error != "Mojang lookup failed" {
+		t.Errorf("upstream error leaked to client: %q", results[1].Error)
+	}
+}
+
+func TestDuplicateUserError(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantErr string
+	}{
+		{"not duplicate", errors.New("database is locked"), "database is locked"},
+		{"sqlite email", errors.New("UNIQUE constraint failed: users.email"), "email exist"},
+		{"sqlite profile name", errors.New("UNIQUE constraint failed: users.profile_name"), "profileName exist"},
+		{"sqlite id", errors.New("UNIQUE constraint failed: users.id"), "profileName was previously used by another profile"},
+		{"mysql email", errors.New("Error 1062: Duplicate entry 'profile_name@example.com' for key 'users.email_idx'"), "email exist"},
+		{"mysql profile name", errors.New("Error 1062: Duplicate entry 'email' for key 'profile_name_idx'"), "profileName exist"},
+		{"mysql primary", errors.New("Error 1062: Duplicate entry 'email' for key 'users.PRIMARY'"), "profileName was previously used by another profile"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorMessage(duplicateUserError(tt.err)); got != tt.wantErr {
+				t.Errorf("duplicateUserError() = %q, want %q", got, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsDuplicateEmail(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("UNIQUE constraint failed: users.email"), true},
+		{errors.New("Error 1062: Duplicate entry 'a@example.com' for key 'users.email_idx'"), true},
+		// 角色名中含有 email 时不应被当作邮箱冲突
+		{errors.New("Error 1062: Duplicate entry 'my_email' for key 'users.profile_name_idx'"), false},
+		{errors.New("UNIQUE constraint failed: users.profile_name"), false},
+		{errors.New("email is invalid"), false},
+	}
+	for _, tt := range tests {
+		if got := isDuplicateEmail(tt.err); got != tt.want {
+			t.Errorf("isDuplicateEmail(%q) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRegisterConcurrentSameEmail(t *testing.T) {
+	u := newTestUserService(t, newTestDB(t), &fakeMojangClient{})
+	SetRegistrationOpen(true)
+
+	const workers = 8
+	results := make(chan error, workers)
+	var start sync.WaitGroup
+	start.Add(1)
+	for i := 0; i < workers; i++ {
+		go func(i int) {
+			start.Wait()
+			_, err := u.Register("racer@example.com", "password", fmt.Sprintf("Racer%d", i), "", fmt.Sprintf("10.0.0.%d", i))
+			results <- err
+		}(i)
+	}
+	start.Done()
+
+	succeeded := 0
+	for i := 0; i < workers; i++ {
+		if err := <-results; err == nil {
+			succeeded++
+		} else if err.Error() != "email exist" {
+			t.Errorf("Register() error = %q, want %q", err.Error(), "email exist")
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d registrations succeeded, want exactly 1", succeeded)
+	}
+	var count int64
+	u.db.Model(&model.User{}).Where("email = ?", "racer@example.com").Count(&count)
+	if count != 1 {
+		t.Errorf("%d users stored, want 1", count)
+	}
+}
+
+func TestRegisterLimitPerIp(t *testing.T) {
+	const limit = 3
+	for _, backend := range []string{"memory", "database"} {
+		t.Run(backend, func(t *testing.T) {
+			db := newTestDB(t)
+			if err := db.AutoMigrate(&model.RateLimit{}); err != nil {
+				t.Fatal(err)
+			}
+			cacheCfg := DefaultCacheCfg()
+			tokenService := NewTokenService(TokenCfg{
+				ValidDuration:   model.DefaultTokenValidDuration,
+				RefreshDuration: model.DefaultTokenRefreshDuration,
+			}, cacheCfg)
+			cfg := UserCfg{
+				RegistrationOpen:   true,
+				RegisterLimitPerIp: limit,
+				BcryptCost:         bcrypt.MinCost,
+				UuidStrategy:       "random",
+				MojangNameCheck:    "off",
+			}
+			u := NewUserService(tokenService, &fakeMojangClient{}, NewProfileCache(cacheCfg), db, cfg, RateLimitCfg{Backend: backend}, TextureCfg{}, cacheCfg)
+			SetRegistrationOpen(true)
+
+			register := func(i int, ip string) error {
+				_, err := u.Register(fmt.Sprintf("user%d@example.com", i), "password", fmt.Sprintf("Player%d", i), "", ip)
+				return err
+			}
+			for i := 0; i < limit; i++ {
+				if err := register(i, "192.0.2.1"); err != nil {
+					t.Fatalf("registration %d error = %v, want nil", i+1, err)
+				}
+			}
+			err := register(limit, "192.0.2.1")
+			var yggError util.YggdrasilError
+			if !errors.As(err, &yggError) || yggError.Status != http.StatusTooManyRequests {
+				t.Fatalf("registration %d error = %#v, want status %d", limit+1, err, http.StatusTooManyRequests)
+			}
+			// 被限流的请求不会创建用户
+			var count int64
+			if err := db.Model(&model.User{}).Where("email = ?", fmt.Sprintf("user%d@example.com", limit)).Count(&count).Error; err != nil {
+				t.Fatal(err)
+			}
+			if count != 0 {
+				t.Errorf("rate-limited registration created %d users", count)
+			}
+			if err := register(limit+1, "192.0.2.2"); err != nil {
+				t.Errorf("registration from another IP error = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestQueryProfilesDetailed(t *testing.T) {
+	mojangClient := &fakeMojangClient{taken: map[string]string{"notch": "069a79f444e94726a5befca90e38aaf5"}}
+	u := newTestUserService(t, newTestDB(t), mojangClient)
+	createTestUser(t, u, "tester@example.com", "Tester")
+	broken, _ := createTestUser(t, u, "broken@example.com", "Broken")
+	if err := u.db.Model(broken).Update("serialized_textures", "{bad").Error; err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"Tester", "Broken", "Notch", "Nobody", "TESTER"}
+
+	// 默认只查询本地, 数据损坏的角色单独标记为失败
+	results, err := u.QueryProfilesDetailed(names, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"Tester": LookupFound, "Broken": LookupError, "Notch": LookupNotFound, "Nobody": LookupNotFound}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d: %+v", len(results), len(want), results)
+	}
+	for _, result := range results {
+		if result.Status != want[result.Name] {
+			t.Errorf("%s: status = %q, want %q", result.Name, result.Status, want[result.Name])
+		}
+	}
+
+	u.cfg.UpstreamProfileLookup = true
+	results, err = u.QueryProfilesDetailed(names, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want["Notch"] = LookupUpstream
+	for _, result := range results {
+		if result.Status != want[result.Name] {
+			t.Errorf("upstream on: %s: status = %q, want %q", result.Name, result.Status, want[result.Name])
+		}
+		if result.Name == "Notch" {
+			profile := result.Profile.(map[string]interface{})
+			if _, ok := profile["legacy"]; ok || profile["id"] != "069a79f444e94726a5befca90e38aaf5" {
+				t.Errorf("upstream profile not sanitized: %v", profile)
+			}
+		}
+	}
+	profiles, err := u.QueryProfiles(names, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 {
+		t.Errorf("QueryProfiles returned %d profiles, want local and upstream: %v", len(profiles), profiles)
+	}
+
+	mojangClient.err = errors.New("connection refused")
+	results, err = u.QueryProfilesDetailed([]string{"Notch"}, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Status != LookupError {
+		t.Errorf("upstream error: status = %q, want %q", results[0].Status, LookupError)
+	}
+}
+
+func TestQueryProfilesDetailedBatchLimit(t *testing.T) {
+	u := newTestUserService(t, newTestDB(t), &fakeMojangClient{})
+	names := make([]string, 0, MaxBulkProfileLookup+1)
+	for i := 0; i < MaxBulkProfileLookup; i++ {
+		names = append(names, fmt.Sprintf("Player%d", i))
+	}
+	// 重复的角色名不计入上限
+	if _, err := u.QueryProfilesDetailed(append(names, "PLAYER0"), true, ""); err != nil {
+		t.Fatalf("%d distinct names: unexpected error %v", MaxBulkProfileLookup, err)
+	}
+	_, err := u.QueryProfilesDetailed(append(names, "Extra"), true, "")
+	var yggdrasilError util.YggdrasilError
+	if !errors.As(err, &yggdrasilError) || yggdrasilError.Status != http.StatusBadRequest {
+		t.Fatalf("%d distinct names: error = %v, want 400", MaxBulkProfileLookup+1, err)
+	}
+}
+
+func TestLoginUnknownEmailMatchesWrongPassword(t *testing.T) {
+	u := newTestUserService(t, newTestDB(t), &fakeMojangClient{})
+	createTestUser(t, u, "tester@example.com", "Tester")
+	// 使用较高代价的假哈希, 通过耗时确认用户不存在时同样执行了 bcrypt 比较
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("dummy"), 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.dummyHash = dummyHash
+	const minDuration = 50 * time.Millisecond
+
+	_, wrongPasswordErr := u.Login("tester@example.com", "wrong", nil, false)
+	start := time.Now()
+	_, unknownEmailErr := u.Login("nobody@example.com", "wrong", nil, false)
+	elapsed := time.Since(start)
+	if wrongPasswordErr == nil || unknownEmailErr == nil {
+		t.Fatalf("Login() errors = %v, %v, want both to fail", wrongPasswordErr, unknownEmailErr)
+	}
+	if !reflect.DeepEqual(wrongPasswordErr, unknownEmailErr) || wrongPasswordErr.Error() != util.MessageInvalidCredentials {
+		t.Errorf("unknown email error = %#v, wrong password error = %#v, want both %q", unknownEmailErr, wrongPasswordErr, util.MessageInvalidCredentials)
+	}
+	if elapsed < minDuration {
+		t.Errorf("Login() with unknown email took %s, dummy hash comparison was skipped", elapsed)
+	}
+
+	wrongPasswordErr = u.Signout("tester@example.com", "wrong")
+	start = time.Now()
+	unknownEmailErr = u.Signout("nobody@example.com", "wrong")
+	elapsed = time.Since(start)
+	if !reflect.DeepEqual(wrongPasswordErr, unknownEmailErr) || errorMessage(unknownEmailErr) != util.MessageInvalidCredentials {
+		t.Errorf("Signout() unknown email error = %#v, wrong password error = %#v, want both %q", unknownEmailErr, wrongPasswordErr, util.MessageInvalidCredentials)
+	}
+	if elapsed < minDuration {
+		t.Errorf("Signout() with unknown email took %s, dummy hash comparison was skipped", elapsed)
+	}
+}
+
+func TestRefreshMalformedToken(t *testing.T) {
+	u := newTestUserService(t, newTestDB(t), &fakeMojangClient{})
+	user, _ := createTestUser(t, u, "tester@example.com", "Tester")
+
+	nilProfile, err := u.tokenService.AcquireToken(user, nil, &model.Profile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletedUser := &model.User{ID: uuid.New(), ProfileName: "Ghost"}
+	deletedProfile, err := u.tokenService.AcquireToken(deletedUser, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken, brokenToken := createTestUser(t, u, "broken@example.com", "Broken")
+	if err := u.db.Model(broken).Update("serialized_textures", "{bad").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		accessToken string
+	}{
+		{"nil profile", nilProfile.AccessToken},
+		{"deleted profile", deletedProfile.AccessToken},
+		{"unparsable profile", brokenToken.AccessToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := u.Refresh(tt.accessToken, nil, true, nil)
+			var yggdrasilError util.YggdrasilError
+			if response != nil || !errors.As(err, &yggdrasilError) || yggdrasilError.Status != http.StatusForbidden {
+				t.Fatalf("Refresh() = %v, %v, want 403", response, err)
+			}
+		})
+	}
+}
+
+func TestRegisterOfflineUuidCollision(t *testing.T) {
+	u := newTestUserService(t, newTestDB(t), &fakeMojangClient{})
+	u.cfg.UuidStrategy = "offline"
+	SetRegistrationOpen(true)
+
+	first, err := u.Register("first@example.com", "password", "Alpha", "", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := util.UnsignedString(util.OfflineUUID("Alpha")); first.Id != want {
+		t.Fatalf("offline uuid = %s, want %s", first.Id, want)
+	}
+	_, token := loginTestUser(t, u, "first@example.com")
+	if err := u.ChangeProfile(token, nil, "Beta"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alpha 已空出, 但由它计算出的 UUID 仍属于改名后的 Beta
+	_, err = u.Register("second@example.com", "password", "Alpha", "", "10.0.0.2")
+	if got := errorMessage(err); got != "profileName was previously used by another profile" {
+		t.Fatalf("Register() error = %q, want offline uuid collision", got)
+	}
+	// 直接插入时由主键冲突兜底, 返回同样的错误
+	u.cfg.UuidStrategy = "random"
+	user, err := u.newUser("third@example.com", "password", "Alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.ID = util.OfflineUUID("Alpha")
+	if got := errorMessage(duplicateUserError(u.db.Create(user).Error)); got != "profileName was previously used by another profile" {
+		t.Errorf("duplicate primary key error = %q, want offline uuid collision", got)
+	}
+}
+
+// loginTestUser 使用 createTestUser 的默认密码登录
+func loginTestUser(t *testing.T, u *userServiceImpl, email string) (*LoginResponse, string) {
+	t.Helper()
+	response, err := u.Login(email, "password", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, response.AccessToken
+}
+
+func TestPlayerAttributes(t *testing.T) {
+	// 默认配置与 main.go 中的默认值一致
+	defaults := PrivilegesCfg{OnlineChat: true, MultiplayerServer: true}
+	type attributes struct {
+		chat, multiplayer, realms, telemetry, profanityFilter bool
+	}
+	tests := []struct {
+		name                string
+		cfg                 PrivilegesCfg
+		chatDisabled        bool
+		multiplayerDisabled bool
+		want                attributes
+	}{
+		{name: "defaults", cfg: defaults, want: attributes{chat: true, multiplayer: true}},
+		{name: "chat disabled for user", cfg: defaults, chatDisabled: true, want: attributes{multiplayer: true}},
+		{name: "multiplayer disabled for user", cfg: defaults, multiplayerDisabled: true, want: attributes{chat: true}},
+		{name: "both disabled for user", cfg: defaults, chatDisabled: true, multiplayerDisabled: true, want: attributes{}},
+		{name: "everything enabled", cfg: PrivilegesCfg{OnlineChat: true, MultiplayerServer: true, MultiplayerRealms: true, Telemetry: true, ProfanityFilter: true},
+			want: attributes{chat: true, multiplayer: true, realms: true, telemetry: true, profanityFilter: true}},
+		{name: "chat disabled globally", cfg: PrivilegesCfg{MultiplayerServer: true, ProfanityFilter: true}, want: attributes{multiplayer: true, profanityFilter: true}},
+		{name: "user override keeps other settings", cfg: PrivilegesCfg{OnlineChat: true, MultiplayerServer: true, Telemetry: true, ProfanityFilter: true}, chatDisabled: true,
+			want: attributes{multiplayer: true, telemetry: true, profanityFilter: true}},
+		{name: "everything disabled", cfg: PrivilegesCfg{}, want: attributes{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newTestUserService(t, newTestDB(t), &fakeMojangClient{})
+			u.cfg.Privileges = tt.cfg
+			user, token := createTestUser(t, u, "tester@example.com", "Tester")
+			err := u.db.Model(user).Updates(map[string]interface{}{
+				"chat_disabled":        tt.chatDisabled,
+				"multiplayer_disabled": tt.multiplayerDisabled,
+			}).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response, err := u.PlayerAttributes(token.AccessToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := attributes{
+				chat:            response.Privileges.OnlineChat.Enabled,
+				multiplayer:     response.Privileges.MultiplayerServer.Enabled,
+				realms:          response.Privileges.MultiplayerRealms.Enabled,
+				telemetry:       response.Privileges.Telemetry.Enabled,
+				profanityFilter: response.ProfanityFilterPreferences.ProfanityFilterOn,
+			}
+			if got != tt.want {
+				t.Errorf("PlayerAttributes() = %+v, want %+v", got, tt.want)
+			}
+			if response.BanStatus.BannedScopes == nil {
+				t.Error("BannedScopes is nil, want empty object")
+			}
+		})
+	}
+
+	u := newTestUserService(t, newTestDB(t), &fakeMojangClient{})
+	if _, err := u.PlayerAttributes("invalid"); errorMessage(err) != util.MessageInvalidToken {
+		t.Errorf("PlayerAttributes(invalid) error = %v, want %q", err, util.MessageInvalidToken)
+	}
+}
+
+func TestBlockList(t *testing.T) {
+	u := newTestUserService(t, newTestDB(t), &fakeMojangClient{})
+	blocker, token := createTestUser(t, u, "tester@example.com", "Tester")
+	first, _ := createTestUser(t, u, "first@example.com", "First")
+	second, _ := createTestUser(t, u, "second@example.com", "Second")
+
+	assertBlocked := func(want ...uuid.UUID) {
+		t.Helper()
+		response, err := u.BlockList(token.AccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(response.BlockedProfiles) != len(want) {
+			t.Fatalf("BlockedProfiles = %v, want %d entries", response.BlockedProfiles, len(want))
+		}
+		for i, id := range want {
+			if response.BlockedProfiles[i] != util.UnsignedString(id) {
+				t.Errorf("BlockedProfiles[%d] = %s, want %s", i, response.BlockedProfiles[i], util.UnsignedString(id))
+			}
+		}
+	}
+
+	assertBlocked()
+	if err := u.BlockPlayer(token.AccessToken, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.BlockPlayer(token.AccessToken, second.ID); err != nil {
+		t.Fatal(err)
+	}
+	// 重复屏蔽不报错, 也不会产生重复记录
+	if err := u.BlockPlayer(token.AccessToken, first.ID); err != nil {
+		t.Fatalf("blocking twice: %v", err)
+	}
+	assertBlocked(first.ID, second.ID)
+
+	if got := errorMessage(u.BlockPlayer(token.AccessToken, blocker.ID)); got != "cannot block yourself" {
+		t.Errorf("blocking yourself: error = %q", got)
+	}
+	if got := errorMessage(u.BlockPlayer(token.AccessToken, uuid.New())); got != util.MessageProfileNotFound {
+		t.Errorf("blocking unknown profile: error = %q", got)
+	}
+	if got := errorMessage(u.BlockPlayer("invalid", first.ID)); got != util.MessageInvalidToken {
+		t.Errorf("blocking with invalid token: error = %q", got)
+	}
+
+	if err := u.UnblockPlayer(token.AccessToken, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	// 取消屏蔽未屏蔽或不存在的角色不报错
+	if err := u.UnblockPlayer(token.AccessToken, uuid.New()); err != nil {
+		t.Fatalf("unblocking unknown id: %v", err)
+	}
+	assertBlocked(second.ID)
+}
+
+func TestLoginUpgradesPasswordHash(t *testing.T) {
+	u := newTestUserService(t, newTestDB(t), &fakeMojangClient{})
+	user, _ := createTestUser(t, u, "tester@example.com", "Tester")
+	if cost, _ := bcrypt.Cost([]byte(user.Password)); cost != bcrypt.MinCost {
+		t.Fatalf("seeded hash cost = %d, want %d", cost, bcrypt.MinCost)
+	}
+	const configuredCost = bcrypt.MinCost + 2
+	u.cfg.BcryptCost = configuredCost
+
+	// 密码错误时不更新哈希
+	if _, err := u.Login("tester@example.com", "wrong", nil, false); err == nil {
+		t.Fatal("login with wrong password succeeded")
+	}
+	if cost := storedHashCost(t, u, user.ID); cost != bcrypt.MinCost {
+		t.Fatalf("hash cost after failed login = %d, want %d", cost, bcrypt.MinCost)
+	}
+
+	loginTestUser(t, u, "tester@example.com")
+	if cost := storedHashCost(t, u, user.ID); cost != configuredCost {
+		t.Fatalf("hash cost after login = %d, want %d", cost, configuredCost)
+	}
+	// 重新哈希后仍可使用原密码登录
+	loginTestUser(t, u, "tester@example.com")
+}
+
+func storedHashCost(t *testing.T, u *userServiceImpl, userId uuid.UUID) int {
+	t.Helper()
+	user := model.User{}
+	if err := u.db.First(&user, userId).Error; err != nil {
+		t.Fatal(err)
+	}
+	cost, err := bcrypt.Cost([]byte(user.Password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cost
+}
@@ -19,14 +19,30 @@ package util
 
 import (
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 	"log"
+	"os"
 	"strings"
+	"time"
 	"yggdrasil-go/util/dialector"
 )
 
 type DbCfg struct {
-	DatabaseDriver string `ini:"database_driver"`
-	DatabaseDsn    string `ini:"database_dsn"`
+	DatabaseDriver string        `ini:"database_driver"`
+	DatabaseDsn    string        `ini:"database_dsn"`
+	SlowThreshold  time.Duration `ini:"slow_threshold"`
+	LogLevel       string        `ini:"log_level"`
+	// ConnectTimeout 启动时数据库不可用时的最长等待时间, 0 表示不重试
+	ConnectTimeout time.Duration `ini:"connect_timeout"`
+	// AutoMigrate 启动时自动创建/更新表结构, 关闭时只检查表是否存在
+	AutoMigrate bool `ini:"database_auto_migrate"`
+}
+
+var dbLogLevels = map[string]logger.LogLevel{
+	"silent": logger.Silent,
+	"error":  logger.Error,
+	"warn":   logger.Warn,
+	"info":   logger.Info,
 }
 
 func GetDialector(cfg DbCfg) gorm.Dialector {
@@ -44,3 +60,47 @@ func GetDialector(cfg DbCfg) gorm.Dialector {
 		return nil
 	}
 }
+
+// GetLogger 按配置的日志级别记录数据库错误, 并将超过 SlowThreshold 的查询记录为慢查询
+func GetLogger(cfg DbCfg) logger.Interface {
+	level, ok := dbLogLevels[strings.ToLower(cfg.LogLevel)]
+	if !ok {
+		log.Panicf("Unknown database log level: %s\nSupported: silent,error,warn,info\n", cfg.LogLevel)
+	}
+	return logger.New(log.New(os.Stdout, "\r\n", log.LstdFlags), logger.Config{
+		SlowThreshold:             cfg.SlowThreshold,
+		LogLevel:                  level,
+		IgnoreRecordNotFoundError: true,
+		Colorful:                  false,
+	})
+}
+
+// IsDuplicateKeyError 判断是否为违反唯一索引的错误 (sqlite / mysql)
+func IsDuplicateKeyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "UNIQUE constraint failed") || strings.Contains(msg, "Error 1062")
+}
+
+// DuplicateKey 返回唯一索引冲突错误中冲突的约束: mysql 为索引名, sqlite 为 "表.列", 非此类错误时返回空字符串
+// 错误信息中可能包含用户输入的重复值, 因此只截取约束部分, 不对整条信息做匹配
+func DuplicateKey(err error) string {
+	if !IsDuplicateKeyError(err) {
+		return ""
+	}
+	msg := err.Error()
+	if i := strings.LastIndex(msg, "UNIQUE constraint failed: "); i >= 0 {
+		return strings.TrimSpace(msg[i+len("UNIQUE constraint failed: "):])
+	}
+	// mysql: Duplicate entry '<value>' for key '<index>', 8.0 起索引名带有表名前缀
+	if i := strings.LastIndex(msg, "for key '"); i >= 0 {
+		key := strings.TrimSuffix(msg[i+len("for key '"):], "'")
+		if j := strings.LastIndex(key, "."); j >= 0 {
+			key = key[j+1:]
+		}
+		return key
+	}
+	return ""
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDuplicateKey(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"nil", nil, ""},
+		{"other error", errors.New("record not found"), ""},
+		{"sqlite", errors.New("UNIQUE constraint failed: users.email"), "users.email"},
+		{"sqlite profile name", errors.New("UNIQUE constraint failed: users.profile_name"), "users.profile_name"},
+		{"mysql 5.7", errors.New("Error 1062: Duplicate entry 'a@example.com' for key 'email_idx'"), "email_idx"},
+		{"mysql 8", errors.New("Error 1062: Duplicate entry 'Steve' for key 'users.profile_name_idx'"), "profile_name_idx"},
+		{"mysql value mentions other index", errors.New("Error 1062: Duplicate entry 'profile_name@example.com' for key 'users.email_idx'"), "email_idx"},
+		{"mysql value contains key marker", errors.New("Error 1062: Duplicate entry 'x' for key 'email_idx'' for key 'users.profile_name_idx'"), "profile_name_idx"},
+		{"mysql primary key", errors.New("Error 1062: Duplicate entry 'abc' for key 'users.PRIMARY'"), "PRIMARY"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DuplicateKey(tt.err); got != tt.want {
+				t.Errorf("DuplicateKey(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
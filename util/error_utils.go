@@ -18,8 +18,13 @@
 package util
 
 import (
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"log"
 	"net/http"
+	"strings"
 )
 
 var MessageInvalidToken = "Invalid token."
@@ -27,6 +32,7 @@ var MessageInvalidCredentials = "Invalid credentials. Invalid username or passwo
 var MessageTokenAlreadyAssigned = "Access token already has a profile assigned."
 var MessageAccessDenied = "Access denied."
 var MessageProfileNotFound = "No such profile."
+var MessagePendingApproval = "Registration is pending approval."
 
 type YggdrasilError struct {
 	ErrorCode    string `json:"error"`
@@ -53,6 +59,23 @@ func NewForbiddenOperationError(msg string) (err YggdrasilError) {
 	return err
 }
 
+// NewBindingError 将请求参数绑定/校验失败的错误转换为列出具体字段的 IllegalArgumentError
+func NewBindingError(err error) YggdrasilError {
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		return NewIllegalArgumentError(err.Error())
+	}
+	fields := make([]string, 0, len(validationErrors))
+	for _, fieldError := range validationErrors {
+		if fieldError.Param() != "" {
+			fields = append(fields, fmt.Sprintf("%s(%s=%s)", fieldError.Field(), fieldError.Tag(), fieldError.Param()))
+		} else {
+			fields = append(fields, fmt.Sprintf("%s(%s)", fieldError.Field(), fieldError.Tag()))
+		}
+	}
+	return NewIllegalArgumentError("Invalid fields: " + strings.Join(fields, ", "))
+}
+
 func HandleError(c *gin.Context, err error) {
 	switch x := err.(type) {
 	case YggdrasilError:
@@ -76,7 +99,11 @@ func HandleError(c *gin.Context, err error) {
 		}
 		break
 	default:
-		c.AbortWithStatusJSON(http.StatusForbidden, x.Error())
+		log.Printf("处理请求 %s 时出错 (请求 ID: %s): %s\n", c.Request.URL.Path, c.GetString(RequestIdKey), x.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, YggdrasilError{
+			ErrorCode:    "Internal Server Error",
+			ErrorMessage: http.StatusText(http.StatusInternalServerError),
+		})
 		break
 	}
 }
@@ -20,13 +20,84 @@ package util
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"strings"
+	"time"
 )
 
+type HttpCfg struct {
+	// RetryCount GET 请求遇到网络错误或可重试的状态码时的最大重试次数, POST 请求不会重试
+	RetryCount int `ini:"retry_count"`
+	// TlsMinVersion 访问外部接口时允许的最低 TLS 版本, 1.2 或 1.3, 为空时使用 Go 的默认值
+	TlsMinVersion string `ini:"tls_min_version"`
+	// TlsCipherSuites 访问外部接口时允许的 TLS 1.2 加密套件 (Go 中的名称), 为空时使用 Go 的默认值
+	TlsCipherSuites []string `ini:"tls_cipher_suites"`
+}
+
+var httpCfg = HttpCfg{
+	RetryCount: 2,
+}
+
+var httpClient = http.DefaultClient
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// SetHttpCfg 设置访问外部接口的参数, 并按 TLS 策略创建共用的 HTTP 客户端
+func SetHttpCfg(cfg HttpCfg) error {
+	tlsConfig := &tls.Config{}
+	if cfg.TlsMinVersion != "" {
+		version, ok := tlsVersions[cfg.TlsMinVersion]
+		if !ok {
+			return fmt.Errorf("不支持的 tls_min_version: %s, 可选 1.2 或 1.3", cfg.TlsMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	for _, name := range cfg.TlsCipherSuites {
+		name = strings.TrimSpace(name)
+		id, ok := secureCipherSuite(name)
+		if !ok {
+			return fmt.Errorf("不支持或不安全的加密套件: %s", name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	httpCfg = cfg
+	httpClient = &http.Client{Transport: transport}
+	return nil
+}
+
+func secureCipherSuite(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// HttpClient 返回访问外部接口使用的 HTTP 客户端
+func HttpClient() *http.Client {
+	return httpClient
+}
+
+const RequestIdKey = "requestId"
+
 func GetObject(url string, value interface{}) error {
-	resp, err := http.Get(url)
+	return GetObjectWithContext(context.Background(), url, value)
+}
+
+func GetObjectWithContext(ctx context.Context, url string, value interface{}) error {
+	resp, err := getWithRetry(ctx, url)
 	if err != nil {
 		return err
 	}
@@ -55,7 +126,7 @@ func GetObject(url string, value interface{}) error {
 }
 
 func GetForString(url string) (string, error) {
-	resp, err := http.Get(url)
+	resp, err := getWithRetry(context.Background(), url)
 	if err != nil {
 		return "", err
 	}
@@ -80,13 +151,22 @@ func GetForString(url string) (string, error) {
 }
 
 func PostObject(url string, data interface{}, result interface{}) error {
+	return PostObjectWithContext(context.Background(), url, data, result)
+}
+
+func PostObjectWithContext(ctx context.Context, url string, data interface{}, result interface{}) error {
 	buf := bytes.Buffer{}
 	encoder := json.NewEncoder(&buf)
 	err := encoder.Encode(data)
 	if err != nil {
 		return err
 	}
-	resp, err := http.Post(url, "application/json", &buf)
+	request, err := http.NewRequestWithContext(ctx, "POST", url, &buf)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(request)
 	if err != nil {
 		return err
 	}
@@ -114,6 +194,24 @@ func PostObject(url string, data interface{}, result interface{}) error {
 	}
 }
 
+// PostBytesWithContext 以指定的 Content-Type 发送原始数据, 响应状态码不是 2xx 时返回错误, 否则解析 JSON 响应
+func PostBytesWithContext(ctx context.Context, url string, contentType string, data []byte, result interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+	resp, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, request.URL.Host)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
 func PostObjectForError(url string, data interface{}) error {
 	buf := bytes.Buffer{}
 	encoder := json.NewEncoder(&buf)
@@ -121,7 +219,7 @@ func PostObjectForError(url string, data interface{}) error {
 	if err != nil {
 		return err
 	}
-	resp, err := http.Post(url, "application/json", &buf)
+	resp, err := httpClient.Post(url, "application/json", &buf)
 	if err != nil {
 		return err
 	}
@@ -148,7 +246,7 @@ func PostForString(url string, accessToken string, data []byte, value interface{
 	if accessToken != "" {
 		request.Header.Set("Authorization", "Bearer "+accessToken)
 	}
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := httpClient.Do(request)
 	if err != nil {
 		return err
 	}
@@ -175,3 +273,71 @@ func PostForString(url string, accessToken string, data []byte, value interface{
 		return json.Unmarshal(body, value)
 	}
 }
+
+// getWithRetry 发送 GET 请求, 对临时性错误以指数退避加随机抖动的方式重试
+func getWithRetry(ctx context.Context, url string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := httpClient.Do(request)
+		if attempt >= httpCfg.RetryCount || ctx.Err() != nil || !isRetryable(resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		select {
+		case <-time.After(retryDelay(attempt)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func isRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+func retryDelay(attempt int) time.Duration {
+	const baseDelay = 100 * time.Millisecond
+	const maxDelay = 2 * time.Second
+	delay := baseDelay << attempt
+	if delay <= 0 || delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// ExtractBearerToken 解析 Authorization 头, scheme 不区分大小写, 与令牌之间至少一个空白
+func ExtractBearerToken(header string) (string, error) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return "", errors.New("missing authorization header")
+	}
+	i := strings.IndexAny(header, " \t")
+	if i < 0 {
+		if strings.EqualFold(header, "Bearer") {
+			return "", errors.New("missing bearer token")
+		}
+		return "", errors.New("malformed authorization header")
+	}
+	if !strings.EqualFold(header[:i], "Bearer") {
+		return "", errors.New("unsupported authorization scheme")
+	}
+	token := strings.TrimSpace(header[i+1:])
+	if token == "" || strings.ContainsAny(token, " \t") {
+		return "", errors.New("malformed bearer token")
+	}
+	return token, nil
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import "testing"
+
+func TestExtractBearerToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    string
+		wantErr string
+	}{
+		{name: "valid", header: "Bearer abc123", want: "abc123"},
+		{name: "empty", header: "", wantErr: "missing authorization header"},
+		{name: "blank", header: "   ", wantErr: "missing authorization header"},
+		{name: "missing scheme", header: "abc123", wantErr: "malformed authorization header"},
+		{name: "other scheme", header: "Basic dXNlcjpwYXNz", wantErr: "unsupported authorization scheme"},
+		{name: "lowercase scheme", header: "bearer abc123", want: "abc123"},
+		{name: "uppercase scheme", header: "BEARER abc123", want: "abc123"},
+		{name: "extra spaces", header: "  Bearer    abc123  ", want: "abc123"},
+		{name: "tab separator", header: "Bearer\tabc123", want: "abc123"},
+		{name: "scheme with no token", header: "Bearer", wantErr: "missing bearer token"},
+		{name: "scheme with trailing space", header: "Bearer ", wantErr: "missing bearer token"},
+		{name: "token with space", header: "Bearer abc 123", wantErr: "malformed bearer token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExtractBearerToken(tt.header)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("ExtractBearerToken(%q) error = %v, want %q", tt.header, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExtractBearerToken(%q) unexpected error: %v", tt.header, err)
+			}
+			if got != tt.want {
+				t.Errorf("ExtractBearerToken(%q) = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
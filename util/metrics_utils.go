@@ -0,0 +1,180 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type gauge struct {
+	help       string
+	metricType string
+	value      func() float64
+}
+
+var (
+	metricsLock sync.RWMutex
+	gauges      = map[string]gauge{}
+	histograms  = map[string]*Histogram{}
+)
+
+// LatencyBuckets 耗时直方图默认的分桶上限 (秒)
+var LatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// Histogram 按标签分组统计观测值的分布, 以 Prometheus histogram 格式导出
+type Histogram struct {
+	help       string
+	buckets    []float64
+	labelNames []string
+	mu         sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	// counts 每个分桶内 (不累计) 的观测次数
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// RegisterGauge 注册一个在导出时计算当前值的指标
+func RegisterGauge(name string, help string, value func() float64) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	gauges[name] = gauge{help: help, metricType: "gauge", value: value}
+}
+
+// RegisterCounter 注册一个只增不减的计数指标
+func RegisterCounter(name string, help string, value func() float64) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	gauges[name] = gauge{help: help, metricType: "counter", value: value}
+}
+
+// RegisterHistogram 注册一个直方图指标, buckets 须按升序排列, 观测时按 labelNames 的顺序提供标签值
+func RegisterHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	h := &Histogram{
+		help:       help,
+		buckets:    buckets,
+		labelNames: labelNames,
+		series:     map[string]*histogramSeries{},
+	}
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	histograms[name] = h
+	return h
+}
+
+// Observe 记录一次观测值
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// ObserveSince 记录从 start 到现在经过的秒数
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+var labelValueEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func (h *Histogram) write(w io.Writer, name string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, h.help, name); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		labels := make([]string, 0, len(h.labelNames)+1)
+		for i, labelName := range h.labelNames {
+			value := ""
+			if i < len(s.labelValues) {
+				value = labelValueEscaper.Replace(s.labelValues[i])
+			}
+			labels = append(labels, fmt.Sprintf("%s=\"%s\"", labelName, value))
+		}
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			if _, err := fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, strings.Join(append(labels, fmt.Sprintf("le=\"%g\"", upper)), ","), cumulative); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket{%s} %d\n%s_sum{%s} %g\n%s_count{%s} %d\n",
+			name, strings.Join(append(labels, `le="+Inf"`), ","), s.count,
+			name, strings.Join(labels, ","), s.sum,
+			name, strings.Join(labels, ","), s.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteMetrics 以 Prometheus 文本格式输出所有指标
+func WriteMetrics(w io.Writer) error {
+	metricsLock.RLock()
+	defer metricsLock.RUnlock()
+	names := make([]string, 0, len(gauges)+len(histograms))
+	for name := range gauges {
+		names = append(names, name)
+	}
+	for name := range histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if h, ok := histograms[name]; ok {
+			if err := h.write(w, name); err != nil {
+				return err
+			}
+			continue
+		}
+		g := gauges[name]
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, g.help, name, g.metricType, name, g.value())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -18,6 +18,7 @@
 package util
 
 import (
+	"crypto/md5"
 	"encoding/hex"
 	"github.com/google/uuid"
 )
@@ -35,3 +36,11 @@ func ToUUID(str string) (uuid.UUID, error) {
 func RandomUUID() string {
 	return UnsignedString(uuid.New())
 }
+
+// OfflineUUID 原版离线模式服务器使用的角色 UUID, 即 Java 的 UUID.nameUUIDFromBytes("OfflinePlayer:" + name)
+func OfflineUUID(name string) uuid.UUID {
+	id := uuid.UUID(md5.Sum([]byte("OfflinePlayer:" + name)))
+	id[6] = id[6]&0x0f | 0x30
+	id[8] = id[8]&0x3f | 0x80
+	return id
+}
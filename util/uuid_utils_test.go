@@ -0,0 +1,45 @@
+/*
+ * Copyright (C) 2022-2023. Gardel <sunxinao@hotmail.com> and contributors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import "testing"
+
+func TestOfflineUUID(t *testing.T) {
+	// 与 Java UUID.nameUUIDFromBytes(("OfflinePlayer:" + name).getBytes(UTF_8)) 的结果一致
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Notch", "b50ad385-829d-3141-a216-7e7d7539ba7f"},
+		{"notch", "42653081-a90e-3475-b3d6-3550cdb43f8e"},
+		{"jeb_", "a762f560-4fce-3236-812a-b80efff0b62b"},
+		{"Steve", "5627dd98-e6be-3c21-b8a8-e92344183641"},
+	}
+	for _, tt := range tests {
+		id := OfflineUUID(tt.name)
+		if got := id.String(); got != tt.want {
+			t.Errorf("OfflineUUID(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+		if id.Version() != 3 {
+			t.Errorf("OfflineUUID(%q) version = %d, want 3", tt.name, id.Version())
+		}
+		if id != OfflineUUID(tt.name) {
+			t.Errorf("OfflineUUID(%q) is not deterministic", tt.name)
+		}
+	}
+}